@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
 	"./ws"
@@ -10,14 +9,17 @@ import (
 
 func main() {
 	http.Handle("/ws", ws.Handler(func(conn *ws.Conn) {
-		data, err := ioutil.ReadAll(conn)
-		if err != nil {
-			fmt.Println("接收失败", err.Error())
-		} else {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				fmt.Println("接收失败", err.Error())
+				return
+			}
 			fmt.Println(string(data))
-			_, err := conn.Write([]byte("hello world too"))
+			err = conn.WriteMessage(messageType, []byte("hello world too"))
 			if err != nil {
 				fmt.Println("发送失败", err.Error())
+				return
 			}
 		}
 	}))
@@ -0,0 +1,115 @@
+package ws
+
+// 这个文件实现了握手时的认证
+// 凭证可以来自Authorization报头, Cookie, 查询参数, 或者Sec-WebSocket-Protocol(浏览器不能设置Authorization报头)
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrMissingCredentials 表示请求中没有凭证, 以401拒绝握手
+	ErrMissingCredentials = &ProtocolError{"missing credentials"}
+	// ErrUnauthorized 表示凭证无效, 以401拒绝握手
+	ErrUnauthorized = &ProtocolError{"unauthorized"}
+	// ErrForbidden 表示凭证有效但没有权限, 以403拒绝握手
+	ErrForbidden = &ProtocolError{"forbidden"}
+)
+
+// CredentialSource 表示凭证的来源
+type CredentialSource int
+
+const (
+	// CredentialHeader 来自Authorization报头
+	CredentialHeader CredentialSource = iota
+	// CredentialCookie 来自Server.AuthCookie指定的Cookie
+	CredentialCookie
+	// CredentialQuery 来自Server.AuthQuery指定的查询参数
+	CredentialQuery
+	// CredentialProtocol 来自带有Server.AuthProtocolPrefix前缀的子协议
+	CredentialProtocol
+)
+
+// Credentials 是从握手请求中提取的凭证
+type Credentials struct {
+	Source CredentialSource
+	// Authorization报头中的认证方案, 如"Bearer", 其他来源为空
+	Scheme string
+	Token  string
+	// 凭证所在的完整子协议, 只用于回显
+	protocol string
+}
+
+// Authenticator 校验凭证, 返回代表用户的principal. 请求中没有凭证时creds为nil
+// 返回的错误包装ErrForbidden时以403拒绝握手, 其他错误以401拒绝
+type Authenticator func(req *http.Request, creds *Credentials) (principal interface{}, err error)
+
+// Principal 返回认证时Authenticator返回的principal, 没有认证时为nil
+func (c *Conn) Principal() interface{} {
+	return c.principal
+}
+
+// extractCredentials 按照报头, Cookie, 查询参数, 子协议的顺序提取凭证
+// 从子协议中提取的凭证将从config.Protocol中删除, 不参与子协议选择
+func (s *Server) extractCredentials(config *Config, req *http.Request) *Credentials {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		scheme, token, _ := strings.Cut(auth, " ")
+		return &Credentials{Source: CredentialHeader, Scheme: scheme, Token: strings.TrimSpace(token)}
+	}
+	if s.AuthCookie != "" {
+		if cookie, err := req.Cookie(s.AuthCookie); err == nil && cookie.Value != "" {
+			return &Credentials{Source: CredentialCookie, Token: cookie.Value}
+		}
+	}
+	if s.AuthQuery != "" {
+		if token := req.URL.Query().Get(s.AuthQuery); token != "" {
+			return &Credentials{Source: CredentialQuery, Token: token}
+		}
+	}
+	if s.AuthProtocolPrefix != "" {
+		for i, protocol := range config.Protocol {
+			if strings.HasPrefix(protocol, s.AuthProtocolPrefix) {
+				config.Protocol = append(config.Protocol[:i:i], config.Protocol[i+1:]...)
+				return &Credentials{
+					Source:   CredentialProtocol,
+					Token:    protocol[len(s.AuthProtocolPrefix):],
+					protocol: protocol,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// authenticate 校验凭证, 失败时返回响应状态码
+func (s *Server) authenticate(req *http.Request, creds *Credentials) (principal interface{}, code int, err error) {
+	principal, err = s.Authenticator(req, creds)
+	if err == nil {
+		return principal, http.StatusSwitchingProtocols, nil
+	}
+	if errors.Is(err, ErrForbidden) {
+		return nil, http.StatusForbidden, err
+	}
+	if creds == nil && !errors.Is(err, ErrMissingCredentials) {
+		err = ErrMissingCredentials
+	}
+	return nil, http.StatusUnauthorized, err
+}
+
+// authChallenge 生成401响应的WWW-Authenticate, 参见RFC 6750
+func (s *Server) authChallenge(reason error) string {
+	challenge := "Bearer"
+	if s.AuthRealm != "" {
+		challenge += " realm=" + strconv.Quote(s.AuthRealm)
+	}
+	if !errors.Is(reason, ErrMissingCredentials) {
+		if s.AuthRealm != "" {
+			challenge += ","
+		}
+		challenge += ` error="invalid_token"`
+	}
+	return challenge
+}
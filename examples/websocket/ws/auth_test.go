@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAuthProtocolEcho(t *testing.T) {
+	s := &Server{
+		Subprotocols:       []string{"chat"},
+		AuthProtocolPrefix: "access_token.",
+		Authenticator: func(req *http.Request, creds *Credentials) (interface{}, error) {
+			if creds == nil || creds.Token != "secret" {
+				return nil, ErrUnauthorized
+			}
+			return "alice", nil
+		},
+		Handler: func(c *Conn) {
+			// 服务端协商的子协议不包括凭证
+			msg := fmt.Sprintf("%s %q %q", c.Principal(), c.Subprotocol(), c.HandshakeInfo().Subprotocol)
+			c.WriteMessage(TextFrame, []byte(msg))
+		},
+	}
+	_, url := newTestServer(t, s)
+
+	tests := []struct {
+		offered []string
+		// 响应中的子协议和服务端协商的子协议
+		echo, want string
+	}{
+		// 只有凭证子协议时回显它
+		{[]string{"access_token.secret"}, "access_token.secret", ""},
+		// 选中了其他子协议时不回显
+		{[]string{"access_token.secret", "chat"}, "chat", "chat"},
+		{[]string{"access_token.secret", "unknown"}, "access_token.secret", ""},
+	}
+	for _, tt := range tests {
+		config, err := NewConfig(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Protocol = tt.offered
+		c, err := DialConfig(config)
+		if err != nil {
+			t.Errorf("%v: %v", tt.offered, err)
+			continue
+		}
+		if got := c.HandshakeInfo().Subprotocol; got != tt.echo {
+			t.Errorf("%v: response Subprotocol = %q, want %q", tt.offered, got, tt.echo)
+		}
+		want := fmt.Sprintf("alice %q %q", tt.want, tt.want)
+		if _, p, err := c.ReadMessage(); err != nil || string(p) != want {
+			t.Errorf("%v: server reported %s, %v, want %s", tt.offered, p, err, want)
+		}
+		c.Close()
+	}
+}
+
+func TestAuthReject(t *testing.T) {
+	s := &Server{
+		AuthRealm: "chat",
+		Authenticator: func(req *http.Request, creds *Credentials) (interface{}, error) {
+			switch {
+			case creds == nil:
+				return nil, ErrMissingCredentials
+			case creds.Token == "guest":
+				return nil, fmt.Errorf("read only: %w", ErrForbidden)
+			case creds.Token != "secret":
+				return nil, ErrUnauthorized
+			}
+			return "alice", nil
+		},
+		Handler: func(c *Conn) {},
+	}
+	srv, _ := newTestServer(t, s)
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{"missing credentials", "", http.StatusUnauthorized, `Bearer realm="chat"`},
+		{"invalid token", "Bearer wrong", http.StatusUnauthorized, `Bearer realm="chat", error="invalid_token"`},
+		{"forbidden", "Bearer guest", http.StatusForbidden, ""},
+		{"valid token", "Bearer secret", http.StatusSwitchingProtocols, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.authorization != "" {
+				header.Set("Authorization", tt.authorization)
+			}
+			resp := upgrade(t, srv, header)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+		})
+	}
+}
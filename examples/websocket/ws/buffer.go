@@ -0,0 +1,113 @@
+package ws
+
+// 这个文件实现了读写缓冲的大小配置和池化
+// 写缓冲只在写入帧时借用, 配置ReadBufferPool后读缓冲只在读取帧时持有, 大量空闲连接时可以减少内存占用
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// 未配置缓冲大小时, 池中缓冲的大小
+const defaultBufferSize = 4096
+
+// BufferPool 是读写缓冲池, *sync.Pool实现了该接口
+// 池中的对象是*bufio.Reader或*bufio.Writer, 大小与配置不符的对象将被丢弃
+type BufferPool interface {
+	Get() interface{}
+	Put(interface{})
+}
+
+func bufferSize(size int) int {
+	if size <= 0 {
+		return defaultBufferSize
+	}
+	return size
+}
+
+// 未配置WriteBufferPool时使用的写缓冲池, 按缓冲大小区分
+var defaultWriteBufferPools sync.Map // int -> *sync.Pool
+
+func defaultWriteBufferPool(size int) BufferPool {
+	if pool, ok := defaultWriteBufferPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := defaultWriteBufferPools.LoadOrStore(size, new(sync.Pool))
+	return pool.(*sync.Pool)
+}
+
+// prepare 在读取帧之前调用, 此时上一帧已经读完
+// 读缓冲中没有数据时, 按配置的大小更换缓冲, 或者将缓冲归还到池中, 等连接上有新数据时再借用
+func (fac *hybiFrameReaderFactory) prepare() error {
+	if fac.Reader != nil && fac.Buffered() > 0 {
+		return nil
+	}
+	if fac.pool == nil {
+		if fac.size > 0 && fac.Reader.Size() != fac.size {
+			fac.Reader = bufio.NewReaderSize(fac.rwc, fac.size)
+		}
+		return nil
+	}
+
+	if fac.Reader != nil {
+		fac.Reset(nil)
+		fac.pool.Put(fac.Reader)
+		fac.Reader = nil
+	}
+	// 空闲时不持有缓冲, 阻塞在读取第一个字节上
+	if _, err := io.ReadFull(fac.rwc, fac.first.b[:]); err != nil {
+		return err
+	}
+	fac.first.pending = true
+
+	size := bufferSize(fac.size)
+	br, _ := fac.pool.Get().(*bufio.Reader)
+	if br == nil || br.Size() != size {
+		br = bufio.NewReaderSize(&fac.first, size)
+	} else {
+		br.Reset(&fac.first)
+	}
+	fac.Reader = br
+	return nil
+}
+
+// firstReader 先返回空闲时读到的第一个字节, 再从底层连接读取
+type firstReader struct {
+	r       io.Reader
+	b       [1]byte
+	pending bool
+}
+
+func (r *firstReader) Read(p []byte) (n int, err error) {
+	if !r.pending || len(p) == 0 {
+		return r.r.Read(p)
+	}
+	p[0] = r.b[0]
+	r.pending = false
+	// 一个帧至少有2个字节, 可以继续读取
+	n, err = r.r.Read(p[1:])
+	return n + 1, err
+}
+
+// acquire 从池中借用写入一帧的缓冲
+func (fac *hybiFrameWriterFactory) acquire() *bufio.Writer {
+	bw, _ := fac.pool.Get().(*bufio.Writer)
+	if bw == nil || bw.Size() != fac.size {
+		return bufio.NewWriterSize(fac.rwc, fac.size)
+	}
+	bw.Reset(fac.rwc)
+	return bw
+}
+
+// release 在一帧写完后归还缓冲
+func (fac *hybiFrameWriterFactory) release(bw *bufio.Writer) {
+	bw.Reset(nil)
+	fac.pool.Put(bw)
+}
+
+// writeRaw 写入已经编码好的帧, 帧已经完整, 不需要缓冲
+func (fac *hybiFrameWriterFactory) writeRaw(frame []byte) error {
+	_, err := fac.rwc.Write(frame)
+	return err
+}
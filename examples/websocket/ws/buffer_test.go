@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingPool 记录借出和归还的次数
+type countingPool struct {
+	sync.Pool
+	gets, puts atomic.Int64
+}
+
+func (p *countingPool) Get() interface{} {
+	p.gets.Add(1)
+	return p.Pool.Get()
+}
+
+func (p *countingPool) Put(x interface{}) {
+	p.puts.Add(1)
+	p.Pool.Put(x)
+}
+
+func TestBufferPool(t *testing.T) {
+	readPool, writePool := new(countingPool), new(countingPool)
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	server := newHybiConn(&Config{
+		ReadBufferSize:  1024,
+		ReadBufferPool:  readPool,
+		WriteBufferPool: writePool,
+	}, nil, s, &http.Request{})
+	client := newHybiConn(&Config{}, nil, c, nil)
+
+	// 包括超过读缓冲大小的消息
+	messages := []string{"hello", strings.Repeat("x", 5000), "world"}
+	go func() {
+		for _, msg := range messages {
+			if err := client.WriteMessage(TextFrame, []byte(msg)); err != nil {
+				return
+			}
+		}
+	}()
+	for _, want := range messages {
+		_, p, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != want {
+			t.Fatalf("read %d bytes, want %d", len(p), len(want))
+		}
+	}
+
+	go func() {
+		for _, msg := range messages {
+			if err := server.WriteMessage(TextFrame, []byte(msg)); err != nil {
+				return
+			}
+		}
+	}()
+	for range messages {
+		if _, _, err := client.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 写完一帧后归还写缓冲, 可能晚于对端读到消息
+	waitFor(t, "write buffer release", func() bool {
+		return writePool.puts.Load() == int64(len(messages))
+	})
+	if n := writePool.gets.Load(); n != int64(len(messages)) {
+		t.Errorf("write pool: %d gets, want %d", n, len(messages))
+	}
+
+	// 空闲时读缓冲归还到池中
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ReadMessage()
+	}()
+	waitFor(t, "read buffer release", func() bool {
+		gets := readPool.gets.Load()
+		return gets > 0 && readPool.puts.Load() == gets
+	})
+	client.Close()
+	<-done
+}
@@ -0,0 +1,133 @@
+package ws
+
+// 这个文件实现了客户端的主要接口
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// StatusError 表示服务端没有以101响应握手, 如认证失败(401, 403)或超过连接限制(429, 503)
+// errors.Is(err, ErrBadStatus)对StatusError成立
+type StatusError struct {
+	// 响应状态码
+	StatusCode int
+	// 响应中Retry-After指定的重试等待时间, 没有时为0
+	RetryAfter time.Duration
+	// 响应报头, 如401响应的WWW-Authenticate
+	Header http.Header
+}
+
+func (e *StatusError) Error() string {
+	return ErrBadStatus.Error() + " " + strconv.Itoa(e.StatusCode)
+}
+
+// Is 使errors.Is(err, ErrBadStatus)成立
+func (e *StatusError) Is(target error) bool {
+	return target == ErrBadStatus
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	err := &StatusError{StatusCode: resp.StatusCode, Header: resp.Header}
+	// Retry-After可以是秒数或者HTTP日期
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if seconds, e := strconv.Atoi(v); e == nil && seconds > 0 {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		} else if t, e := http.ParseTime(v); e == nil {
+			err.RetryAfter = max(time.Until(t), 0)
+		}
+	}
+	return err
+}
+
+// NewConfig 根据服务地址创建客户端配置
+func NewConfig(server string) (config *Config, err error) {
+	config = new(Config)
+	config.Version = ProtocolVersionHybi13
+	config.Location, err = url.ParseRequestURI(server)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Dial 连接到websocket服务, protocol为空时表示不使用子协议
+func Dial(server, protocol string) (ws *Conn, err error) {
+	config, err := NewConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	if protocol != "" {
+		config.Protocol = []string{protocol}
+	}
+	return DialConfig(config)
+}
+
+// DialConfig 根据配置建立连接并完成握手
+func DialConfig(config *Config) (ws *Conn, err error) {
+	if config.Location == nil {
+		return nil, ErrBadLocation
+	}
+
+	var conn net.Conn
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	switch config.Location.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", parseAuthority(config.Location))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", parseAuthority(config.Location), config.TlsConfig)
+	default:
+		err = ErrBadScheme
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err = NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// NewClient 在已有的连接上进行客户端握手, 握手失败时不会关闭rwc
+// 握手结果(协议版本, 子协议等)写入config的副本, 同一个config可以用于多次连接
+func NewClient(config *Config, rwc io.ReadWriteCloser) (ws *Conn, err error) {
+	c := new(Config)
+	*c = *config
+	config = c
+
+	br := bufio.NewReader(rwc)
+	bw := bufio.NewWriter(rwc)
+	buf := bufio.NewReadWriter(br, bw)
+
+	hs := hybiClientHandshaker{Config: config}
+	if err = hs.WriteHandshake(bw); err != nil {
+		return nil, err
+	}
+	if err = hs.ReadHandshake(br); err != nil {
+		return nil, err
+	}
+	return hs.NewClientConn(buf, rwc), nil
+}
+
+// 未指定端口时使用默认端口
+func parseAuthority(location *url.URL) string {
+	if location.Port() != "" {
+		return location.Host
+	}
+	if location.Scheme == "wss" {
+		return net.JoinHostPort(location.Hostname(), "443")
+	}
+	return net.JoinHostPort(location.Hostname(), "80")
+}
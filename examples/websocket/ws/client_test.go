@@ -0,0 +1,117 @@
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoMessages 通过回显服务端收发一组消息
+func echoMessages(t *testing.T, c *Conn) {
+	t.Helper()
+	messages := []struct {
+		messageType byte
+		data        string
+	}{
+		{TextFrame, ""},
+		{TextFrame, "hello"},
+		{TextFrame, "hello"},
+		{BinaryFrame, "\x00\xff\x01"},
+		{TextFrame, strings.Repeat("héllo wörld ", 2000)},
+		{BinaryFrame, strings.Repeat("\x00\x01\x02\x03", 50000)},
+	}
+	for _, m := range messages {
+		if err := c.WriteMessage(m.messageType, []byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+		messageType, p, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != m.messageType || string(p) != m.data {
+			t.Fatalf("echo = %d %.20q, want %d %.20q", messageType, p, m.messageType, m.data)
+		}
+	}
+}
+
+func TestDialRoundTrip(t *testing.T) {
+	_, url := newEchoServer(t, Config{})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.IsClientConn() {
+		t.Error("IsClientConn() = false")
+	}
+	echoMessages(t, c)
+}
+
+func TestDialKeepsConfig(t *testing.T) {
+	// 服务端不选择任何子协议
+	s := &Server{
+		SelectSubprotocol: func(req *http.Request, offered []string) string { return "" },
+		Handler:           func(c *Conn) { c.ReadMessage() },
+	}
+	_, url := newTestServer(t, s)
+	config, err := NewConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"v1", "v2"}
+	want := *config
+
+	for i := 0; i < 2; i++ {
+		c, err := DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Subprotocol(); got != "" {
+			t.Errorf("Subprotocol = %q, want empty", got)
+		}
+		c.Close()
+		if !reflect.DeepEqual(*config, want) {
+			t.Fatalf("dial %d changed config: Protocol = %q, want %q", i, config.Protocol, want.Protocol)
+		}
+	}
+}
+
+func TestDialStatusError(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		want       time.Duration
+	}{
+		{http.StatusUnauthorized, "", 0},
+		{http.StatusForbidden, "", 0},
+		{http.StatusTooManyRequests, "3", 3 * time.Second},
+		{http.StatusServiceUnavailable, "invalid", 0},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if tt.retryAfter != "" {
+				w.Header().Set("Retry-After", tt.retryAfter)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		_, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "")
+		srv.Close()
+
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			t.Errorf("%d: err = %v, want *StatusError", tt.status, err)
+			continue
+		}
+		if statusErr.StatusCode != tt.status || statusErr.RetryAfter != tt.want {
+			t.Errorf("%d: got status %d, retry after %v, want %v",
+				tt.status, statusErr.StatusCode, statusErr.RetryAfter, tt.want)
+		}
+		if !errors.Is(err, ErrBadStatus) {
+			t.Errorf("%d: errors.Is(err, ErrBadStatus) = false", tt.status)
+		}
+	}
+}
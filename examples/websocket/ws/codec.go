@@ -0,0 +1,144 @@
+package ws
+
+// 这个文件实现了通用的消息编解码接口和内置的编解码器
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// ErrBadCodecValue 表示编解码器不支持该类型的值
+var ErrBadCodecValue = &ProtocolError{"unsupported codec value"}
+
+// Codec 定义了一种消息格式, 如protobuf, msgpack
+type Codec interface {
+	// Marshal 将v编码为消息载荷
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal 将消息载荷解码到v
+	Unmarshal(data []byte, v interface{}) error
+	// FrameType 返回发送消息时使用的类型, TextFrame或BinaryFrame
+	FrameType() byte
+}
+
+// DecodeError 表示消息不能解码到目标值, 连接仍然可用
+// 连接上的错误(如*CloseError, ErrMessageTooLarge)将原样返回
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "decode: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// JSONCodec 使用encoding/json, 以TextFrame发送
+	JSONCodec Codec = jsonCodec{}
+	// RawCodec 收发[]byte, 以BinaryFrame发送
+	RawCodec Codec = rawCodec{}
+	// TextCodec 收发string, 以TextFrame发送
+	TextCodec Codec = textCodec{}
+)
+
+// Send 使用codec编码v, 作为一条消息发送, 可以被多个goroutine同时调用
+// 消息类型由codec决定, 与PayloadType无关
+func (c *Conn) Send(codec Codec, v interface{}) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w := c.newWriter(codec.FrameType())
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Receive 读取下一条消息并使用codec解码到v, 解码失败时返回*DecodeError
+func (c *Conn) Receive(codec Codec, v interface{}) error {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err = codec.Unmarshal(data, v); err != nil {
+		return &DecodeError{Err: err}
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) FrameType() byte {
+	return TextFrame
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return nil, ErrBadCodecValue
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return ErrBadCodecValue
+	}
+	*p = data
+	return nil
+}
+
+func (rawCodec) FrameType() byte {
+	return BinaryFrame
+}
+
+type textCodec struct{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case string:
+		return []byte(data), nil
+	case *string:
+		return []byte(*data), nil
+	case []byte:
+		return data, nil
+	}
+	return nil, ErrBadCodecValue
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *string:
+		*p = string(data)
+	case *[]byte:
+		*p = data
+	default:
+		return ErrBadCodecValue
+	}
+	return nil
+}
+
+func (textCodec) FrameType() byte {
+	return TextFrame
+}
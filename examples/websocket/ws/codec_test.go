@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	type point struct{ X, Y int }
+	hello := "hello"
+	tests := []struct {
+		name  string
+		codec Codec
+		send  interface{}
+		// 接收的目标和期望的值
+		recv, want interface{}
+		frameType  byte
+	}{
+		{"json", JSONCodec, point{1, 2}, new(point), &point{1, 2}, TextFrame},
+		{"raw", RawCodec, []byte{0, 0xff}, new([]byte), &[]byte{0, 0xff}, BinaryFrame},
+		{"text string", TextCodec, "hello", new(string), &hello, TextFrame},
+		{"text bytes", TextCodec, []byte("hello"), new([]byte), &[]byte{'h', 'e', 'l', 'l', 'o'}, TextFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newPipeConns(t)
+			go func() {
+				if err := client.Send(tt.codec, tt.send); err != nil {
+					t.Error(err)
+				}
+				// 第二条消息用于检查消息类型
+				client.Send(tt.codec, tt.send)
+			}()
+			if err := server.Receive(tt.codec, tt.recv); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.recv, tt.want) {
+				t.Errorf("received %v, want %v", tt.recv, tt.want)
+			}
+			messageType, _, err := server.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != tt.frameType {
+				t.Errorf("frame type %d, want %d", messageType, tt.frameType)
+			}
+		})
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	server, client := newPipeConns(t)
+	if err := client.Send(RawCodec, "not bytes"); err != ErrBadCodecValue {
+		t.Errorf("Send = %v, want %v", err, ErrBadCodecValue)
+	}
+
+	go client.Send(TextCodec, "not json")
+	var v interface{}
+	var de *DecodeError
+	if err := server.Receive(JSONCodec, &v); !errors.As(err, &de) {
+		t.Errorf("Receive = %v, want *DecodeError", err)
+	}
+
+	// 连接错误原样返回
+	client.rwc.(net.Conn).Close()
+	if err := server.Receive(JSONCodec, &v); errors.As(err, &de) || err == nil {
+		t.Errorf("Receive after close = %v, want connection error", err)
+	}
+}
@@ -0,0 +1,367 @@
+package ws
+
+// 这个文件实现了permessage-deflate扩展
+// 协议原文: https://tools.ietf.org/html/rfc7692
+
+import (
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtensionName = "permessage-deflate"
+
+	// deflate滑动窗口为2^15, 即32KB. compress/flate 只支持最大窗口
+	maxWindowBits = 15
+	maxWindowSize = 1 << maxWindowBits
+	minWindowBits = 8
+
+	defaultCompressionLevel = flate.BestSpeed
+
+	// 压缩消息末尾被去掉的4个字节, 以及一个用于结束deflate流的空块
+	deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+)
+
+var (
+	// ErrBadCompressionLevel 表示压缩级别不在flate.HuffmanOnly和flate.BestCompression之间
+	ErrBadCompressionLevel = &ProtocolError{"bad compression level"}
+	// ErrBadExtension 表示服务端响应的扩展不合法
+	ErrBadExtension = &ProtocolError{"bad websocket extension"}
+)
+
+// deflateParams 是协商后的permessage-deflate参数, 窗口为0表示未指定(即15)
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+// parseDeflateParams 解析permessage-deflate参数, response表示是否是服务端的响应
+func parseDeflateParams(params ExtensionParams, response bool) (p deflateParams, ok bool) {
+	for key, value := range params {
+		switch key {
+		case "server_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return p, false
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			if p.serverMaxWindowBits, ok = parseWindowBits(value); !ok {
+				return p, false
+			}
+		case "client_max_window_bits":
+			// 客户端可以不带值, 表示支持该参数
+			if value == "" && !response {
+				continue
+			}
+			if p.clientMaxWindowBits, ok = parseWindowBits(value); !ok {
+				return p, false
+			}
+		default:
+			return p, false
+		}
+	}
+	return p, true
+}
+
+func parseWindowBits(value string) (bits int, ok bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, false
+	}
+	return bits, true
+}
+
+// params 生成响应参数
+func (p deflateParams) params() ExtensionParams {
+	params := make(ExtensionParams)
+	if p.serverNoContextTakeover {
+		params["server_no_context_takeover"] = ""
+	}
+	if p.clientNoContextTakeover {
+		params["client_no_context_takeover"] = ""
+	}
+	if p.serverMaxWindowBits != 0 {
+		params["server_max_window_bits"] = strconv.Itoa(p.serverMaxWindowBits)
+	}
+	if p.clientMaxWindowBits != 0 {
+		params["client_max_window_bits"] = strconv.Itoa(p.clientMaxWindowBits)
+	}
+	return params
+}
+
+// deflateExtension 是内置的permessage-deflate扩展, 在Config.EnableCompression为true时启用
+type deflateExtension struct {
+	config *Config
+}
+
+func (e deflateExtension) Name() string {
+	return deflateExtensionName
+}
+
+// permessage-deflate 占用RSV1
+func (e deflateExtension) Rsv() [3]bool {
+	return [3]bool{true, false, false}
+}
+
+func (e deflateExtension) Offer() ExtensionParams {
+	params := ExtensionParams{"client_max_window_bits": ""}
+	if e.config.ServerNoContextTakeover {
+		params["server_no_context_takeover"] = ""
+	}
+	if e.config.ClientNoContextTakeover {
+		params["client_no_context_takeover"] = ""
+	}
+	return params
+}
+
+func (e deflateExtension) Accept(response ExtensionParams) (ExtensionConn, error) {
+	p, ok := parseDeflateParams(response, true)
+	if !ok {
+		return nil, ErrBadExtension
+	}
+	return newCompression(&p, false, e.config.CompressionLevel), nil
+}
+
+func (e deflateExtension) Negotiate(offer ExtensionParams) (ExtensionParams, ExtensionConn, bool) {
+	p, ok := parseDeflateParams(offer, false)
+	if !ok {
+		return nil, nil, false
+	}
+	// 不限制客户端的窗口
+	p.clientMaxWindowBits = 0
+	if e.config.ServerNoContextTakeover {
+		p.serverNoContextTakeover = true
+	}
+	if e.config.ClientNoContextTakeover {
+		p.clientNoContextTakeover = true
+	}
+	return p.params(), newCompression(&p, true, e.config.CompressionLevel), true
+}
+
+// compression 保存一个连接的压缩和解压上下文
+type compression struct {
+	// 本端压缩时每条消息都重置上下文
+	writeNoContextTakeover bool
+	// 对端压缩时每条消息都重置上下文
+	readNoContextTakeover bool
+	// 对端限制了本端的窗口时, compress/flate无法满足, 只发送未压缩的消息
+	canWrite    bool
+	enableWrite bool
+	level       int
+
+	fw          *flate.Writer
+	trunc       truncWriter
+	writeWindow slidingWindow
+
+	fr         io.ReadCloser
+	readWindow slidingWindow
+}
+
+func newCompression(p *deflateParams, isServer bool, level int) *compression {
+	if level < flate.HuffmanOnly || level > flate.BestCompression || level == flate.NoCompression {
+		level = defaultCompressionLevel
+	}
+	c := &compression{enableWrite: true, level: level}
+	if isServer {
+		c.writeNoContextTakeover = p.serverNoContextTakeover
+		c.readNoContextTakeover = p.clientNoContextTakeover
+		c.canWrite = p.serverMaxWindowBits == 0 || p.serverMaxWindowBits == maxWindowBits
+	} else {
+		c.writeNoContextTakeover = p.clientNoContextTakeover
+		c.readNoContextTakeover = p.serverNoContextTakeover
+		c.canWrite = p.clientMaxWindowBits == 0 || p.clientMaxWindowBits == maxWindowBits
+	}
+	return c
+}
+
+func (c *compression) writeEnabled() bool {
+	return c.canWrite && c.enableWrite
+}
+
+// setLevel 在下一条消息生效
+func (c *compression) setLevel(level int) {
+	if level != c.level {
+		c.level = level
+		c.fw = nil
+	}
+}
+
+// WrapReader 解压RSV1被设置的消息
+func (c *compression) WrapReader(r io.Reader, rsv [3]bool) io.Reader {
+	if !rsv[0] {
+		return r
+	}
+	src := io.MultiReader(r, strings.NewReader(deflateTail))
+	var dict []byte
+	if !c.readNoContextTakeover {
+		dict = c.readWindow.bytes()
+	}
+	if c.fr == nil {
+		c.fr = flate.NewReaderDict(src, dict)
+	} else {
+		c.fr.(flate.Resetter).Reset(src, dict)
+	}
+	return &decompressReader{c: c}
+}
+
+// decompressReader 读取解压后的数据
+type decompressReader struct {
+	c *compression
+}
+
+func (r *decompressReader) Read(msg []byte) (n int, err error) {
+	n, err = r.c.fr.Read(msg)
+	if !r.c.readNoContextTakeover {
+		r.c.readWindow.write(msg[:n])
+	}
+	return n, err
+}
+
+// WrapWriter 返回压缩消息写入器, 压缩后的数据写入w
+func (c *compression) WrapWriter(w io.WriteCloser) (io.WriteCloser, [3]bool) {
+	if !c.writeEnabled() {
+		return w, [3]bool{}
+	}
+	c.trunc.reset(w)
+	if c.fw == nil {
+		var dict []byte
+		if !c.writeNoContextTakeover {
+			dict = c.writeWindow.bytes()
+		}
+		// level已经校验过, 不会出错
+		c.fw, _ = flate.NewWriterDict(&c.trunc, c.level, dict)
+	} else if c.writeNoContextTakeover {
+		c.fw.Reset(&c.trunc)
+	}
+	// RSV1表示消息被压缩
+	return &compressWriter{w: w, c: c}, [3]bool{true, false, false}
+}
+
+type compressWriter struct {
+	w      io.WriteCloser
+	c      *compression
+	closed bool
+}
+
+func (w *compressWriter) Write(msg []byte) (n int, err error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	n, err = w.c.fw.Write(msg)
+	if !w.c.writeNoContextTakeover {
+		w.c.writeWindow.write(msg[:n])
+	}
+	return n, err
+}
+
+// Close 结束deflate块并去掉末尾的0x00 0x00 0xff 0xff
+func (w *compressWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	// 出错时也要关闭w, 以释放连接的消息写入锁
+	err := w.c.fw.Flush()
+	if err == nil && !w.c.trunc.ok() {
+		err = ErrBadExtension
+	}
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// truncWriter 保留最后4个字节不写入
+type truncWriter struct {
+	w io.Writer
+	n int
+	p [4]byte
+}
+
+func (w *truncWriter) reset(dst io.Writer) {
+	w.w = dst
+	w.n = 0
+}
+
+func (w *truncWriter) Write(p []byte) (int, error) {
+	n := 0
+	// 先填满保留的4个字节
+	if w.n < len(w.p) {
+		n = copy(w.p[w.n:], p)
+		p = p[n:]
+		w.n += n
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+
+	m := len(p)
+	if m > len(w.p) {
+		m = len(w.p)
+	}
+	if nn, err := w.w.Write(w.p[:m]); err != nil {
+		return n + nn, err
+	}
+	copy(w.p[:], w.p[m:])
+	copy(w.p[len(w.p)-m:], p[len(p)-m:])
+	nn, err := w.w.Write(p[:len(p)-m])
+	return n + nn, err
+}
+
+// ok 表示保留的4个字节是deflate的同步标记
+func (w *truncWriter) ok() bool {
+	return w.n == len(w.p) && string(w.p[:]) == deflateTail[:4]
+}
+
+// slidingWindow 保存最近32KB的数据, 作为上下文接管时的字典
+type slidingWindow struct {
+	buf []byte
+}
+
+func (w *slidingWindow) write(p []byte) {
+	if len(p) >= maxWindowSize {
+		w.buf = append(w.buf[:0], p[len(p)-maxWindowSize:]...)
+		return
+	}
+	if drop := len(w.buf) + len(p) - maxWindowSize; drop > 0 {
+		w.buf = append(w.buf[:0], w.buf[drop:]...)
+	}
+	w.buf = append(w.buf, p...)
+}
+
+func (w *slidingWindow) bytes() []byte {
+	return w.buf
+}
+
+// SetCompressionLevel 设置压缩级别, 在下一条消息生效
+// 与NextWriter相同, 正在写入的消息写完之后才会返回
+func (c *Conn) SetCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return ErrBadCompressionLevel
+	}
+	if c.compression != nil {
+		c.wmsg.Lock()
+		c.compression.setLevel(level)
+		c.wmsg.Unlock()
+	}
+	return nil
+}
+
+// EnableWriteCompression 设置是否压缩发送的消息, 只在协商了permessage-deflate时有效
+// 与NextWriter相同, 正在写入的消息写完之后才会返回
+func (c *Conn) EnableWriteCompression(enable bool) {
+	if c.compression != nil {
+		c.wmsg.Lock()
+		c.compression.enableWrite = enable
+		c.wmsg.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		server Config
+		// 客户端是否请求压缩
+		compress bool
+		// 期望协商的扩展, 为空表示不压缩
+		extension string
+	}{
+		{
+			name:      "deflate with context takeover",
+			server:    Config{EnableCompression: true},
+			compress:  true,
+			extension: "permessage-deflate",
+		},
+		{
+			name:      "deflate without context takeover",
+			server:    Config{EnableCompression: true, ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			compress:  true,
+			extension: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+		},
+		{
+			name:     "compression disabled on server",
+			compress: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newEchoServer(t, tt.server)
+			config, err := NewConfig(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.EnableCompression = tt.compress
+			c, err := DialConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			var got string
+			if exts := c.HandshakeInfo().Extensions; len(exts) > 0 {
+				got = exts[0]
+			}
+			if got != tt.extension {
+				t.Errorf("extension = %q, want %q", got, tt.extension)
+			}
+			echoMessages(t, c)
+
+			// 分片发送的消息
+			w, err := c.NextWriter(TextFrame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			for i := 0; i < 10; i++ {
+				chunk := strings.Repeat("fragment ", 1000)
+				want.WriteString(chunk)
+				if _, err := w.Write([]byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, p, err := c.ReadMessage(); err != nil || !bytes.Equal(p, want.Bytes()) {
+				t.Fatalf("fragmented echo: len %d, err %v", len(p), err)
+			}
+		})
+	}
+}
+
+func TestCompressionSettingsRace(t *testing.T) {
+	_, url := newEchoServer(t, Config{EnableCompression: true})
+	config, err := NewConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.EnableCompression = true
+	c, err := DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 修改压缩设置与写入消息并发进行
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.EnableWriteCompression(i%2 == 0)
+			c.SetCompressionLevel(flate.BestSpeed + i%3)
+		}
+	}()
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := c.WriteMessage(TextFrame, []byte("compressible compressible compressible")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
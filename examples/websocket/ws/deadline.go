@@ -0,0 +1,159 @@
+package ws
+
+// 这个文件实现了读写超时和context.Context支持
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDeadlineNotSupported 表示底层连接不支持设置超时
+var ErrDeadlineNotSupported = &ProtocolError{"deadline not supported"}
+
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// SetDeadline 设置底层连接的读写超时, 零值表示不超时
+// 超时后连接不再可用, 需要关闭
+func (c *Conn) SetDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+	storeDeadline(&c.writeDeadline, t)
+	if conn, ok := c.rwc.(deadlineSetter); ok {
+		return conn.SetDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
+// SetReadDeadline 设置底层连接的读取超时
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+	return c.setReadDeadline(t)
+}
+
+// SetWriteDeadline 设置底层连接的写入超时
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&c.writeDeadline, t)
+	return c.setWriteDeadline(t)
+}
+
+// setReadDeadline 临时修改读取超时, 不影响调用者设置的超时
+func (c *Conn) setReadDeadline(t time.Time) error {
+	if conn, ok := c.rwc.(deadlineSetter); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
+// setWriteDeadline 临时修改写入超时, 不影响调用者设置的超时
+func (c *Conn) setWriteDeadline(t time.Time) error {
+	if conn, ok := c.rwc.(deadlineSetter); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
+// restoreReadDeadline 恢复调用者设置的读取超时
+func (c *Conn) restoreReadDeadline() {
+	c.setReadDeadline(loadDeadline(&c.readDeadline))
+}
+
+// restoreWriteDeadline 恢复调用者设置的写入超时
+func (c *Conn) restoreWriteDeadline() {
+	c.setWriteDeadline(loadDeadline(&c.writeDeadline))
+}
+
+func storeDeadline(v *atomic.Int64, t time.Time) {
+	if t.IsZero() {
+		v.Store(0)
+	} else {
+		v.Store(t.UnixNano())
+	}
+}
+
+func loadDeadline(v *atomic.Int64) time.Time {
+	if n := v.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// ReadMessageContext 读取一条消息, ctx被取消时中断读取, 返回ctx.Err()
+// 读取被中断后消息流不再完整, 将发送1001关闭帧并关闭连接
+// 对端关闭连接(*CloseError)时, 即使ctx同时被取消也返回该错误
+func (c *Conn) ReadMessageContext(ctx context.Context) (messageType byte, p []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	stop := watchContext(ctx, func() {
+		// 不支持超时的连接只能直接关闭
+		if c.setReadDeadline(time.Now()) != nil {
+			c.closeRWC()
+		}
+	})
+	messageType, p, err = c.ReadMessage()
+	if stop() {
+		var closeErr *CloseError
+		if err == nil || errors.As(err, &closeErr) {
+			// 读取在取消之前已经结束, 恢复调用者的超时设置
+			c.restoreReadDeadline()
+			return messageType, p, err
+		}
+		// 写入方向仍然完整, 可以发送关闭帧
+		c.frameHandler.WriteClose(closeStatusGoingAway, "")
+		c.closeRWC()
+		return 0, nil, ctx.Err()
+	}
+	return messageType, p, err
+}
+
+// WriteMessageContext 发送一条消息, ctx被取消时中断写入, 返回ctx.Err()
+// 写入被中断时帧可能不完整, 无法再发送关闭帧, 将直接关闭连接(对端视为1006)
+func (c *Conn) WriteMessageContext(ctx context.Context, messageType byte, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := watchContext(ctx, func() {
+		if c.setWriteDeadline(time.Now()) != nil {
+			c.closeRWC()
+		}
+	})
+	err := c.WriteMessage(messageType, data)
+	if stop() {
+		if err == nil {
+			// 消息在取消之前已经写完, 恢复调用者的超时设置
+			c.restoreWriteDeadline()
+			return nil
+		}
+		c.closeRWC()
+		return ctx.Err()
+	}
+	return err
+}
+
+// watchContext 在ctx被取消时调用abort. 返回的stop函数结束监视, 并报告abort是否被调用
+// abort被调用不代表操作被中断, 操作可能在abort之前已经完成
+func watchContext(ctx context.Context, abort func()) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort()
+			aborted <- true
+		case <-done:
+			aborted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-aborted
+	}
+}
@@ -0,0 +1,163 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// deadlineConn 记录设置的超时, 并在读写之前调用钩子
+type deadlineConn struct {
+	in          io.Reader
+	out         bytes.Buffer
+	beforeRead  func()
+	beforeWrite func()
+	// 每次设置超时时发送
+	readDeadlines  chan time.Time
+	writeDeadlines chan time.Time
+}
+
+func newDeadlineConn(in io.Reader) *deadlineConn {
+	return &deadlineConn{
+		in:             in,
+		readDeadlines:  make(chan time.Time, 10),
+		writeDeadlines: make(chan time.Time, 10),
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if f := c.beforeRead; f != nil {
+		c.beforeRead = nil
+		f()
+	}
+	return c.in.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if f := c.beforeWrite; f != nil {
+		c.beforeWrite = nil
+		f()
+	}
+	return c.out.Write(p)
+}
+
+func (c *deadlineConn) Close() error { return nil }
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadlines <- t
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadlines <- t
+	return nil
+}
+
+// lastDeadline 返回最近一次设置的超时
+func lastDeadline(t *testing.T, ch chan time.Time) time.Time {
+	t.Helper()
+	var last time.Time
+	for {
+		select {
+		case last = <-ch:
+		default:
+			return last
+		}
+	}
+}
+
+func TestReadMessageContextLateCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []byte
+		err   error
+	}{
+		{
+			name:  "message",
+			frame: clientFrame(true, TextFrame, "hello"),
+			want:  []byte("hello"),
+		},
+		{
+			name:  "close",
+			frame: clientFrame(true, CloseFrame, closePayload(CloseGoingAway)),
+			err:   &CloseError{Code: CloseGoingAway},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rwc := newDeadlineConn(bytes.NewReader(tt.frame))
+			c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+			deadline := time.Now().Add(time.Hour)
+			c.SetReadDeadline(deadline)
+
+			// ctx在数据到达的同时被取消, 读取仍然成功
+			ctx, cancel := context.WithCancel(context.Background())
+			rwc.beforeRead = func() {
+				cancel()
+				<-rwc.readDeadlines
+			}
+			<-rwc.readDeadlines
+			_, p, err := c.ReadMessageContext(ctx)
+			if !bytes.Equal(p, tt.want) || !reflect.DeepEqual(err, tt.err) {
+				t.Fatalf("ReadMessageContext = %q, %v, want %q, %v", p, err, tt.want, tt.err)
+			}
+			if got := lastDeadline(t, rwc.readDeadlines); !got.Equal(deadline) {
+				t.Errorf("read deadline = %v, want %v", got, deadline)
+			}
+		})
+	}
+}
+
+func TestReadMessageContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var rwc *deadlineConn
+	// 读取阻塞到超时被设置
+	rwc = newDeadlineConn(readerFunc(func(p []byte) (int, error) {
+		<-rwc.readDeadlines
+		return 0, os.ErrDeadlineExceeded
+	}))
+	c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+	rwc.beforeRead = cancel
+	if _, _, err := c.ReadMessageContext(ctx); err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+	// 中断读取后以1001关闭
+	if code := closeCode(t, rwc.out.Bytes()); code != CloseGoingAway {
+		t.Errorf("close code = %d, want %d", code, CloseGoingAway)
+	}
+}
+
+func TestWriteMessageContextLateCancel(t *testing.T) {
+	rwc := newDeadlineConn(bytes.NewReader(nil))
+	c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+	deadline := time.Now().Add(time.Hour)
+	c.SetWriteDeadline(deadline)
+	<-rwc.writeDeadlines
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rwc.beforeWrite = func() {
+		cancel()
+		<-rwc.writeDeadlines
+	}
+	if err := c.WriteMessageContext(ctx, TextFrame, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastDeadline(t, rwc.writeDeadlines); !got.Equal(deadline) {
+		t.Errorf("write deadline = %v, want %v", got, deadline)
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
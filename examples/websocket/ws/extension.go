@@ -0,0 +1,233 @@
+package ws
+
+// 这个文件实现了websocket扩展的协商和载荷变换框架
+// 扩展在握手时通过Sec-WebSocket-Extensions协商, 可以占用RSV位并对每条消息的载荷进行变换
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ExtensionParams 是扩展的参数, 值为空字符串表示参数没有值
+type ExtensionParams map[string]string
+
+// Extension 代表一个可以注册到Config中的websocket扩展
+type Extension interface {
+	// Name 返回扩展名, 即Sec-WebSocket-Extensions中的名称
+	Name() string
+	// Rsv 返回扩展占用的RSV位, 不同扩展占用的位不能重叠
+	Rsv() [3]bool
+	// Offer 返回客户端在握手时提供的参数
+	Offer() ExtensionParams
+	// Accept 客户端校验服务端响应的参数, 返回连接使用的扩展实例
+	Accept(response ExtensionParams) (ExtensionConn, error)
+	// Negotiate 服务端根据客户端的参数返回响应参数和连接使用的扩展实例, ok为false时拒绝该offer
+	Negotiate(offer ExtensionParams) (response ExtensionParams, ext ExtensionConn, ok bool)
+}
+
+// ExtensionConn 是一个连接上协商成功的扩展实例, 负责对消息载荷进行变换
+// 发送时按协商顺序依次变换, 接收时按相反的顺序还原
+type ExtensionConn interface {
+	// WrapReader 包装消息读取器, rsv为消息第一帧的RSV位
+	WrapReader(r io.Reader, rsv [3]bool) io.Reader
+	// WrapWriter 包装消息写入器, 返回的rsv将设置在消息的第一帧
+	// 返回的写入器关闭时必须关闭w, 出错时也是如此
+	WrapWriter(w io.WriteCloser) (wc io.WriteCloser, rsv [3]bool)
+}
+
+// extensionOffer 是Sec-WebSocket-Extensions中的一项, 如
+// permessage-deflate; client_max_window_bits
+type extensionOffer struct {
+	name   string
+	params ExtensionParams
+	// 参数重复等格式错误
+	bad bool
+}
+
+// parseExtensions 解析Sec-WebSocket-Extensions报头, 报头可以出现多次, 每个报头包含多个以逗号分隔的扩展
+func parseExtensions(header http.Header) (offers []extensionOffer) {
+	for _, line := range header[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+		for _, item := range strings.Split(line, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+			offer := extensionOffer{name: name, params: make(ExtensionParams)}
+			for _, param := range parts[1:] {
+				var key, value string
+				if i := strings.Index(param, "="); i >= 0 {
+					key = strings.TrimSpace(param[:i])
+					value = strings.Trim(strings.TrimSpace(param[i+1:]), `"`)
+				} else {
+					key = strings.TrimSpace(param)
+				}
+				if key == "" {
+					offer.bad = true
+					continue
+				}
+				if _, ok := offer.params[key]; ok {
+					offer.bad = true
+				}
+				offer.params[key] = value
+			}
+			offers = append(offers, offer)
+		}
+	}
+	return
+}
+
+// formatExtension 生成Sec-WebSocket-Extensions中的一项, 参数按名称排序
+func formatExtension(name string, params ExtensionParams) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s := name
+	for _, key := range keys {
+		s += "; " + key
+		if value := params[key]; value != "" {
+			s += "=" + value
+		}
+	}
+	return s
+}
+
+// configExtensions 返回配置中启用的扩展, 内置的permessage-deflate排在最前
+func configExtensions(config *Config) []Extension {
+	var exts []Extension
+	if config.EnableCompression {
+		exts = append(exts, deflateExtension{config})
+	}
+	return append(exts, config.Extensions...)
+}
+
+// rsvOverlap 表示两组RSV位是否有重叠
+func rsvOverlap(a, b [3]bool) bool {
+	return (a[0] && b[0]) || (a[1] && b[1]) || (a[2] && b[2])
+}
+
+func rsvUnion(a, b [3]bool) [3]bool {
+	return [3]bool{a[0] || b[0], a[1] || b[1], a[2] || b[2]}
+}
+
+// negotiateExtensions 服务端按照客户端的顺序接受扩展, 返回扩展实例和响应报头中的各项
+// 同名的多个offer是候选项, 只接受第一个可以接受的
+func negotiateExtensions(offers []extensionOffer, exts []Extension) (accepted []ExtensionConn, used [3]bool, response []string) {
+	names := make(map[string]bool)
+	for _, offer := range offers {
+		if offer.bad || names[offer.name] {
+			continue
+		}
+		for _, ext := range exts {
+			if ext.Name() != offer.name || rsvOverlap(used, ext.Rsv()) {
+				continue
+			}
+			params, ec, ok := ext.Negotiate(offer.params)
+			if !ok {
+				continue
+			}
+			names[offer.name] = true
+			used = rsvUnion(used, ext.Rsv())
+			accepted = append(accepted, ec)
+			response = append(response, formatExtension(offer.name, params))
+			break
+		}
+	}
+	return accepted, used, response
+}
+
+// offerExtensions 客户端在握手时提供的扩展
+func offerExtensions(exts []Extension) string {
+	items := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		items = append(items, formatExtension(ext.Name(), ext.Offer()))
+	}
+	return strings.Join(items, ", ")
+}
+
+// acceptExtensions 客户端校验服务端响应的扩展, 服务端只能接受客户端提供的扩展
+func acceptExtensions(responses []extensionOffer, exts []Extension) (accepted []ExtensionConn, used [3]bool, err error) {
+	names := make(map[string]bool)
+	for _, resp := range responses {
+		if resp.bad || names[resp.name] {
+			return nil, used, ErrBadExtension
+		}
+		var ext Extension
+		for _, e := range exts {
+			if e.Name() == resp.name {
+				ext = e
+				break
+			}
+		}
+		if ext == nil || rsvOverlap(used, ext.Rsv()) {
+			return nil, used, ErrBadExtension
+		}
+		ec, err := ext.Accept(resp.params)
+		if err != nil {
+			return nil, used, err
+		}
+		names[resp.name] = true
+		used = rsvUnion(used, ext.Rsv())
+		accepted = append(accepted, ec)
+	}
+	return accepted, used, nil
+}
+
+// setExtensions 设置连接上协商成功的扩展, rsv为扩展占用的RSV位, 严格模式下只有这些位可以被设置
+func (c *Conn) setExtensions(exts []ExtensionConn, rsv [3]bool) {
+	c.extensions = exts
+	c.extensionRsv = rsv
+	for _, ext := range exts {
+		if comp, ok := ext.(*compression); ok {
+			c.compression = comp
+		}
+	}
+}
+
+// wrapReader 按与发送相反的顺序还原消息载荷
+func (c *Conn) wrapReader(r io.Reader, rsv [3]bool) io.Reader {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		r = c.extensions[i].WrapReader(r, rsv)
+	}
+	return &extensionReader{conn: c, r: r}
+}
+
+// wrapWriter 按协商顺序变换消息载荷, 第一个扩展最先处理数据
+func (c *Conn) wrapWriter(mw *messageWriter) io.WriteCloser {
+	var w io.WriteCloser = mw
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		var rsv [3]bool
+		w, rsv = c.extensions[i].WrapWriter(w)
+		mw.rsv = rsvUnion(mw.rsv, rsv)
+	}
+	return w
+}
+
+// extensionReader 检查变换后的消息长度, 扩展返回的错误将以1007关闭连接
+type extensionReader struct {
+	conn *Conn
+	r    io.Reader
+	n    int64
+}
+
+func (r *extensionReader) Read(msg []byte) (n int, err error) {
+	n, err = r.r.Read(msg)
+	r.n += int64(n)
+	if max := r.conn.MaxPayloadBytes; max > 0 && r.n > max {
+		return 0, r.conn.failRead(closeStatusTooBigData, ErrMessageTooLarge)
+	}
+	if err != nil && err != io.EOF {
+		r.conn.rio.Lock()
+		readErr := r.conn.readErr
+		r.conn.rio.Unlock()
+		if readErr == nil {
+			return n, r.conn.failRead(closeStatusBadMessageData, err)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,46 @@
+package ws
+
+// 这个文件实现了握手信息的查询
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+)
+
+// HandshakeInfo 是握手时的请求信息和协商结果
+type HandshakeInfo struct {
+	// 服务端为握手请求的报头, 客户端为握手响应的报头
+	Header http.Header
+	// 服务端为请求中的Cookie, 客户端为响应设置的Cookie
+	Cookies []*http.Cookie
+	// 请求地址中的查询参数
+	Query url.Values
+	// 选定的子协议, 没有时为空字符串
+	Subprotocol string
+	// 协商成功的扩展, 格式与Sec-WebSocket-Extensions中的一项相同, 如"permessage-deflate; server_no_context_takeover"
+	Extensions []string
+	// websocket协议版本
+	Version int
+	// Sec-WebSocket-Key
+	Key string
+	// TLS连接状态, 非TLS连接为nil
+	TLS *tls.ConnectionState
+}
+
+// HandshakeInfo 返回握手信息, 返回值是副本, 修改它不影响连接
+func (c *Conn) HandshakeInfo() HandshakeInfo {
+	info := c.handshake
+	info.Header = info.Header.Clone()
+	info.Cookies = append([]*http.Cookie(nil), info.Cookies...)
+	info.Query = cloneValues(info.Query)
+	info.Extensions = append([]string(nil), info.Extensions...)
+	return info
+}
+
+func cloneValues(v url.Values) url.Values {
+	if v == nil {
+		return nil
+	}
+	return url.Values(http.Header(v).Clone())
+}
@@ -0,0 +1,147 @@
+package ws
+
+// 这个文件实现了Ping/Pong处理和连接保活
+
+import (
+	"time"
+)
+
+// SetPingHandler 设置收到Ping时的处理函数, 为nil时使用默认行为: 回复相同载荷的Pong
+// 处理函数在读取消息的goroutine中调用, 返回的错误将作为读取错误
+func (c *Conn) SetPingHandler(h func(appData []byte) error) {
+	c.pingHandler = h
+}
+
+// SetPongHandler 设置收到Pong时的处理函数, 为nil时忽略Pong
+func (c *Conn) SetPongHandler(h func(appData []byte) error) {
+	c.pongHandler = h
+}
+
+// WritePing 发送Ping, 载荷不能超过125字节
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeControl(PingFrame, data)
+}
+
+// WritePong 发送Pong, 载荷不能超过125字节
+func (c *Conn) WritePong(data []byte) error {
+	return c.writeControl(PongFrame, data)
+}
+
+func (c *Conn) writeControl(payloadType byte, data []byte) error {
+	if len(data) > maxControlFramePayloadLength {
+		return ErrControlFrameTooLarge
+	}
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	_, err := c.writeFrame(payloadType, true, [3]bool{}, data)
+	return err
+}
+
+// handlePing 在frameHandler收到Ping时调用
+func (c *Conn) handlePing(data []byte) error {
+	if c.pingHandler != nil {
+		return c.pingHandler(data)
+	}
+	err := c.WritePong(data)
+	if err == ErrCloseSent {
+		// 已经开始关闭握手, 不再回复
+		return nil
+	}
+	return err
+}
+
+// handlePong 在frameHandler收到Pong时调用
+func (c *Conn) handlePong(data []byte) error {
+	c.lastPong.Store(time.Now().UnixNano())
+	c.recordPong(data)
+	if c.pongHandler != nil {
+		return c.pongHandler(data)
+	}
+	return nil
+}
+
+// touch 记录数据消息的读写时间, 用于空闲检测
+func (c *Conn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// heartbeat 定期发送Ping并检查Pong和空闲时间, 直到连接关闭
+// pongWait内没有收到Pong或者Ping无法写出时直接关闭底层连接(1006), 空闲超过idleTimeout时以1001关闭
+// Pong只有在应用读取连接时才会被处理
+func (c *Conn) heartbeat(pingInterval, pongWait, idleTimeout time.Duration) {
+	period := pingInterval
+	if period <= 0 {
+		period = idleTimeout / 2
+	}
+	if period <= 0 {
+		return
+	}
+	// 写入Ping的最长时间, 对端停止读取时写入将一直阻塞, 之后的Pong检查也无法进行
+	pingTimeout := pongWait
+	if pingTimeout <= 0 {
+		pingTimeout = period
+	}
+	c.touch()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	var pongTimer *time.Timer
+	var pongTimeout <-chan time.Time
+	var pingSent int64
+	// 心跳的Ping同样用于测量延迟, 未收到Pong的Ping不再等待
+	var nonce uint64
+	defer func() {
+		if pongTimer != nil {
+			pongTimer.Stop()
+		}
+		c.cancelPing(nonce)
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-pongTimeout:
+			pongTimeout = nil
+			if c.lastPong.Load() < pingSent {
+				c.abort(&CloseError{Code: closeStatusAbnormalClosure, Text: "pong timeout"})
+				return
+			}
+		case now := <-ticker.C:
+			if idleTimeout > 0 && now.Sub(time.Unix(0, c.lastActivity.Load())) > idleTimeout {
+				c.CloseWithReason(closeStatusGoingAway, "idle timeout")
+				return
+			}
+			if pingInterval <= 0 || pongTimeout != nil {
+				continue
+			}
+			pingSent = now.UnixNano()
+			c.cancelPing(nonce)
+			var err error
+			if nonce, err = c.sendHeartbeatPing(pingTimeout); err != nil {
+				if err != ErrCloseSent {
+					// 对端不再读取, 写缓冲已满
+					c.abort(&CloseError{Code: closeStatusAbnormalClosure, Text: "ping timeout"})
+				}
+				return
+			}
+			if pongWait > 0 {
+				if pongTimer == nil {
+					pongTimer = time.NewTimer(pongWait)
+				} else {
+					pongTimer.Reset(pongWait)
+				}
+				pongTimeout = pongTimer.C
+			}
+		}
+	}
+}
+
+// sendHeartbeatPing 在timeout内发送心跳Ping, 之后恢复调用者的写入超时
+// 超时同样会中断阻塞中的数据消息写入, 对端停止读取时连接本来也无法继续使用
+func (c *Conn) sendHeartbeatPing(timeout time.Duration) (nonce uint64, err error) {
+	if c.setWriteDeadline(time.Now().Add(timeout)) == nil {
+		defer c.restoreWriteDeadline()
+	}
+	return c.sendPing(nil)
+}
@@ -0,0 +1,35 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatBlockedWrite(t *testing.T) {
+	done := make(chan error, 1)
+	_, url := newTestServer(t, &Server{
+		PingInterval: 100 * time.Millisecond,
+		PongWait:     200 * time.Millisecond,
+		Handler: func(c *Conn) {
+			// 对端不读取, 写入最终阻塞
+			data := make([]byte, 1<<20)
+			for {
+				if err := c.WriteMessage(BinaryFrame, data); err != nil {
+					done <- err
+					return
+				}
+			}
+		},
+	})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeRWC()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead peer not detected")
+	}
+}
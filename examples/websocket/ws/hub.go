@@ -0,0 +1,259 @@
+package ws
+
+// 这个文件实现了连接登记, 房间和消息广播
+// 每个登记的连接有一个有界的发送队列, 由单独的goroutine通过WritePreparedMessage写出
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowConsumerPolicy 决定连接的发送队列已满时如何处理新消息
+type SlowConsumerPolicy int
+
+const (
+	// PolicyDrop 丢弃新消息
+	PolicyDrop SlowConsumerPolicy = iota
+	// PolicyDisconnect 注销连接并以1008关闭
+	PolicyDisconnect
+	// PolicyBlock 阻塞直到队列有空位或连接被注销
+	PolicyBlock
+)
+
+const (
+	// 默认发送队列长度
+	defaultHubQueueSize = 64
+	// 断开慢连接时写入关闭帧的最长时间
+	slowConsumerCloseTimeout = time.Second
+)
+
+// ErrNotRegistered 表示连接没有登记到Hub
+var ErrNotRegistered = &ProtocolError{"conn not registered"}
+
+// Hub 管理一组连接和房间, 零值可以直接使用
+// 连接读取出错(包括收到关闭帧)或底层连接关闭时将自动注销
+// 登记后应通过Hub发送消息, 不要再直接调用连接的写方法, 否则消息可能交错或乱序
+type Hub struct {
+	// 每个连接的发送队列长度, 为0时使用64
+	QueueSize int
+	// 发送队列已满时的处理方式
+	Policy SlowConsumerPolicy
+
+	mu      sync.Mutex
+	clients map[*Conn]*hubClient
+	rooms   map[string]map[*hubClient]struct{}
+}
+
+// hubClient 是一个登记的连接
+type hubClient struct {
+	conn  *Conn
+	send  chan *PreparedMessage
+	rooms map[string]struct{}
+	// 注销时关闭
+	done chan struct{}
+}
+
+// Register 登记连接, 并启动发送goroutine. 重复登记不做任何事
+func (h *Hub) Register(conn *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[conn]; ok {
+		return
+	}
+	if h.clients == nil {
+		h.clients = make(map[*Conn]*hubClient)
+	}
+	size := h.QueueSize
+	if size <= 0 {
+		size = defaultHubQueueSize
+	}
+	client := &hubClient{
+		conn:  conn,
+		send:  make(chan *PreparedMessage, size),
+		rooms: make(map[string]struct{}),
+		done:  make(chan struct{}),
+	}
+	h.clients[conn] = client
+	go h.writeLoop(client)
+	go h.watch(client)
+}
+
+// Unregister 注销连接并离开所有房间, 队列中未发送的消息将被丢弃, 连接本身不会被关闭
+func (h *Hub) Unregister(conn *Conn) {
+	h.mu.Lock()
+	client := h.clients[conn]
+	h.mu.Unlock()
+	if client != nil {
+		h.remove(client)
+	}
+}
+
+// Join 将连接加入房间
+func (h *Hub) Join(conn *Conn, room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if h.rooms == nil {
+		h.rooms = make(map[string]map[*hubClient]struct{})
+	}
+	members := h.rooms[room]
+	if members == nil {
+		members = make(map[*hubClient]struct{})
+		h.rooms[room] = members
+	}
+	members[client] = struct{}{}
+	client.rooms[room] = struct{}{}
+	return nil
+}
+
+// Leave 将连接移出房间
+func (h *Hub) Leave(conn *Conn, room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return ErrNotRegistered
+	}
+	h.leave(client, room)
+	return nil
+}
+
+// Broadcast 向房间内的所有连接发送一条消息, 消息只编码一次
+// data在所有连接间共享, 调用后不能再修改
+func (h *Hub) Broadcast(room string, messageType byte, data []byte) error {
+	pm, err := NewPreparedMessage(messageType, data)
+	if err != nil {
+		return err
+	}
+	return h.BroadcastPrepared(room, pm)
+}
+
+// BroadcastPrepared 向房间内的所有连接发送预编码消息
+func (h *Hub) BroadcastPrepared(room string, pm *PreparedMessage) error {
+	h.mu.Lock()
+	clients := make([]*hubClient, 0, len(h.rooms[room]))
+	for client := range h.rooms[room] {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.enqueue(client, pm)
+	}
+	return nil
+}
+
+// Send 通过连接的发送队列发送一条消息
+func (h *Hub) Send(conn *Conn, messageType byte, data []byte) error {
+	pm, err := NewPreparedMessage(messageType, data)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	client, ok := h.clients[conn]
+	h.mu.Unlock()
+	if !ok {
+		return ErrNotRegistered
+	}
+	h.enqueue(client, pm)
+	return nil
+}
+
+// Members 返回房间内的连接数
+func (h *Hub) Members(room string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms[room])
+}
+
+// enqueue 按照Policy将消息放入发送队列
+func (h *Hub) enqueue(client *hubClient, msg *PreparedMessage) {
+	if h.Policy == PolicyBlock {
+		select {
+		case client.send <- msg:
+		case <-client.done:
+		}
+		return
+	}
+	select {
+	case client.send <- msg:
+	case <-client.done:
+	default:
+		if h.Policy == PolicyDisconnect {
+			if h.remove(client) {
+				go disconnect(client.conn)
+			}
+		}
+	}
+}
+
+// writeLoop 依次写出发送队列中的消息, 写入出错时注销连接
+func (h *Hub) writeLoop(client *hubClient) {
+	for {
+		select {
+		case msg := <-client.send:
+			// 两个case同时就绪时select随机选择, 已注销的连接不再写入
+			select {
+			case <-client.done:
+				return
+			default:
+			}
+			if err := client.conn.WritePreparedMessage(msg); err != nil {
+				h.remove(client)
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// watch 在连接读取出错或关闭后注销连接
+func (h *Hub) watch(client *hubClient) {
+	select {
+	case <-client.conn.readDone:
+	case <-client.conn.done:
+	case <-client.done:
+		return
+	}
+	h.remove(client)
+}
+
+// disconnect 以1008关闭慢连接
+// writeLoop可能阻塞在写入中并持有写锁, 先设置写入超时使其返回, 否则关闭帧永远无法发出
+func disconnect(conn *Conn) {
+	if conn.setWriteDeadline(time.Now().Add(slowConsumerCloseTimeout)) != nil {
+		conn.abort(&CloseError{Code: closeStatusPolicyViolation, Text: "slow consumer"})
+		return
+	}
+	conn.CloseWithReason(closeStatusPolicyViolation, "slow consumer")
+}
+
+// remove 注销连接, 返回是否是本次调用注销的
+func (h *Hub) remove(client *hubClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[client.conn] != client {
+		return false
+	}
+	delete(h.clients, client.conn)
+	for room := range client.rooms {
+		h.leave(client, room)
+	}
+	close(client.done)
+	return true
+}
+
+// leave 需要持有mu
+func (h *Hub) leave(client *hubClient, room string) {
+	delete(client.rooms, room)
+	if members := h.rooms[room]; members != nil {
+		delete(members, client)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPipeConns 返回通过net.Pipe相连的服务端和客户端连接
+func newPipeConns(t *testing.T) (server, client *Conn) {
+	s, c := net.Pipe()
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return newHybiConn(&Config{}, nil, s, &http.Request{}), newHybiConn(&Config{}, nil, c, nil)
+}
+
+// waitFor 等待cond成立, 超时则失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fillQueue 在对端不读取时持续广播, 直到写入goroutine阻塞, 队列已满, 连接被注销
+func fillQueue(t *testing.T, h *Hub, room string) {
+	t.Helper()
+	data := []byte(strings.Repeat("x", 1024))
+	waitFor(t, "slow consumer to be unregistered", func() bool {
+		if err := h.Broadcast(room, TextFrame, data); err != nil {
+			t.Fatal(err)
+		}
+		return h.Members(room) == 0
+	})
+}
+
+func TestHubSlowConsumerClose(t *testing.T) {
+	server, client := newPipeConns(t)
+	h := &Hub{QueueSize: 1, Policy: PolicyDisconnect}
+	h.Register(server)
+	if err := h.Join(server, "room"); err != nil {
+		t.Fatal(err)
+	}
+	fillQueue(t, h, "room")
+
+	// 注销后对端开始读取, 阻塞的写入完成后应收到1008关闭帧
+	var err error
+	for err == nil {
+		_, _, err = client.ReadMessage()
+	}
+	want := &CloseError{Code: closeStatusPolicyViolation, Text: "slow consumer"}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("client read: %v, want %v", err, want)
+	}
+	if err := h.Send(server, TextFrame, []byte("late")); err != ErrNotRegistered {
+		t.Errorf("Send after disconnect = %v, want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestHubSlowConsumerStalled(t *testing.T) {
+	server, _ := newPipeConns(t)
+	h := &Hub{QueueSize: 1, Policy: PolicyDisconnect}
+	h.Register(server)
+	h.Join(server, "room")
+	fillQueue(t, h, "room")
+
+	// 对端始终不读取, 写入超时后连接被关闭
+	select {
+	case <-server.done:
+	case <-time.After(slowConsumerCloseTimeout + 5*time.Second):
+		t.Fatal("stalled connection was not closed")
+	}
+}
+
+func TestHubUnregisterOnPeerClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(client *Conn) error
+	}{
+		{"close frame", (*Conn).Close},
+		{"connection closed", (*Conn).closeRWC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newPipeConns(t)
+			h := &Hub{}
+			h.Register(server)
+			h.Join(server, "a")
+			h.Join(server, "b")
+			go func() {
+				for {
+					if _, _, err := server.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			tt.close(client)
+			waitFor(t, "unregister", func() bool {
+				return h.Members("a") == 0 && h.Members("b") == 0
+			})
+			if err := h.Join(server, "a"); err != ErrNotRegistered {
+				t.Errorf("Join after peer close = %v, want %v", err, ErrNotRegistered)
+			}
+		})
+	}
+}
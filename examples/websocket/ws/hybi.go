@@ -4,11 +4,11 @@ package ws
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"unicode/utf8"
 )
 
 const (
@@ -27,22 +27,28 @@ const (
 	closeStatusPolicyViolation   = 1008
 	closeStatusTooBigData        = 1009
 	closeStatusExtensionMismatch = 1010
+	closeStatusInternalError     = 1011
 
 	// 控制帧(Control Frames) 包括Close, Ping, Pong. 控制帧的载荷最大长度不会超过125
 	maxControlFramePayloadLength = 125
+
+	// 帧头最长14字节: 2字节基本报头, 8字节扩展长度, 4字节Masking-key
+	maxFrameHeaderSize = 2 + 8 + 4
 )
 
 var (
 	// Websocket协议规定的报头列表
 	handshakeHeaders = map[string]bool{
-		"Host":                   true,
-		"Upgrade":                true,
-		"Connection":             true,
-		"Sec-Websocket-Key":      true,
-		"Sec-Websocket-Origin":   true,
-		"Sec-Websocket-Version":  true,
-		"Sec-Websocket-Protocol": true,
-		"Sec-Websocket-Accept":   true,
+		"Host":                     true,
+		"Upgrade":                  true,
+		"Connection":               true,
+		"Origin":                   true,
+		"Sec-Websocket-Key":        true,
+		"Sec-Websocket-Origin":     true,
+		"Sec-Websocket-Version":    true,
+		"Sec-Websocket-Protocol":   true,
+		"Sec-Websocket-Accept":     true,
+		"Sec-Websocket-Extensions": true,
 	}
 )
 
@@ -57,32 +63,53 @@ type hybiFrameHeader struct {
 	Length int64
 	// 掩码键
 	MaskingKey []byte
-
-	// 报头原始数据
-	data *bytes.Buffer
 }
 
 // rwc 是面向流的网络连接， 其实现了io.ReadWriteClose接口
 // buf 是对rwc的缓冲式的读写接口
 func newHybiServerConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser, req *http.Request) *Conn {
+	return newHybiConn(config, buf, rwc, req)
+}
+
+// 客户端连接没有对应的http请求
+func newHybiClientConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser) *Conn {
+	return newHybiConn(config, buf, rwc, nil)
+}
+
+// req 为nil时表示客户端连接
+func newHybiConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser, req *http.Request) *Conn {
 	if buf == nil {
 		br := bufio.NewReader(rwc)
 		bw := bufio.NewWriter(rwc)
 		buf = bufio.NewReadWriter(br, bw)
 	}
 
+	maxPayloadBytes := config.MaxPayloadBytes
+	if maxPayloadBytes == 0 {
+		maxPayloadBytes = DefaultMaxPayloadBytes
+	}
+	maxFramePayloadBytes := config.MaxFramePayloadBytes
+	if maxFramePayloadBytes == 0 {
+		maxFramePayloadBytes = maxPayloadBytes
+	}
+
 	wsconn := &Conn{
-		config:             config,
-		request:            req,
-		buf:                buf,
-		rwc:                rwc,
-		PayloadType:        TextFrame,
-		defaultCloseStatus: closeStatusNormal,
-		frameReaderFactory: hybiFrameReaderFactory{buf.Reader},
+		config:               config,
+		request:              req,
+		rwc:                  rwc,
+		PayloadType:          BinaryFrame,
+		defaultCloseStatus:   closeStatusNormal,
+		readFin:              true,
+		MaxPayloadBytes:      maxPayloadBytes,
+		maxFramePayloadBytes: maxFramePayloadBytes,
+		closeRcvd:            make(chan struct{}),
+		readDone:             make(chan struct{}),
+		done:                 make(chan struct{}),
+		frameReaderFactory:   newHybiFrameReaderFactory(config, buf.Reader, rwc),
 		// 客户端才需要Masking-key
-		frameWriterFactory: hybiFrameWriterFactory{buf.Writer, req == nil},
+		frameWriterFactory: newHybiFrameWriterFactory(config, rwc, req == nil),
 	}
-	wsconn.frameHandler = &hybiFrameHandler{conn: wsconn}
+	wsconn.frameHandler = &hybiFrameHandler{conn: wsconn, strict: !config.DisableStrictMode}
 	return wsconn
 }
 
@@ -90,37 +117,53 @@ func newHybiServerConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCl
 type hybiFrameHandler struct {
 	conn        *Conn
 	payloadType byte
+	// 当前消息已接收的载荷长度
+	messageLength int64
+	// 是否有未完成的分片消息
+	inMessage bool
+	// 严格模式下校验RSV, 操作码, 控制帧和分片顺序
+	strict bool
 }
 
 func (h *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader, err error) {
-	// TODO check MaskingKey
+	header := &frame.(*hybiFrameReader).header
 	if h.conn.IsServerConn() {
 		// 客户端请求必须带maskingkey
-		if frame.(*hybiFrameReader).header.MaskingKey == nil {
-			h.WriteClose(closeStatusProtocolError)
-			return nil, io.EOF
+		if header.MaskingKey == nil {
+			return h.fail(closeStatusProtocolError, ErrMaskRequired)
 		}
 	} else {
 		// 服务端必须没有mask所有帧
-		if frame.(*hybiFrameReader).header.MaskingKey != nil {
-			h.WriteClose(closeStatusProtocolError)
-			return nil, io.EOF
+		if header.MaskingKey != nil {
+			return h.fail(closeStatusProtocolError, ErrUnexpectedMask)
+		}
+	}
+
+	if h.strict {
+		if err := h.validate(header); err != nil {
+			return h.fail(closeStatusProtocolError, err)
 		}
 	}
 
-	// 这一步有什么用? 清空header?
-	if header := frame.HeaderReader(); header != nil {
-		io.Copy(ioutil.Discard, header)
+	// 在读取载荷之前检查长度
+	length := header.Length
+	if max := h.conn.maxFramePayloadBytes; max > 0 && length > max {
+		return h.fail(closeStatusTooBigData, ErrFrameTooLarge)
 	}
 
 	switch frame.PayloadType() {
 	// 分片
 	case ContinuationFrame:
-		frame.(*hybiFrameReader).header.OpCode = h.payloadType
+		header.OpCode = h.payloadType
+		h.messageLength += length
+		h.inMessage = !header.Fin
 	case TextFrame, BinaryFrame:
 		h.payloadType = frame.PayloadType()
+		h.messageLength = length
+		h.inMessage = !header.Fin
+		h.conn.touch()
 	case CloseFrame:
-		return nil, io.EOF
+		return nil, h.handleClose(frame)
 	case PingFrame, PongFrame:
 		b := make([]byte, maxControlFramePayloadLength)
 		n, err := io.ReadFull(frame, b)
@@ -129,41 +172,136 @@ func (h *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader, err er
 		}
 		// 忽略剩余的数据
 		io.Copy(ioutil.Discard, frame)
-		// 回复Pong
 		if frame.PayloadType() == PingFrame {
-			if _, err := h.WritePong(b[:n]); err != nil {
-				return nil, err
-			}
+			err = h.conn.handlePing(b[:n])
+		} else {
+			err = h.conn.handlePong(b[:n])
 		}
-		return nil, nil
+		return nil, err
+	}
+
+	if max := h.conn.MaxPayloadBytes; max > 0 && h.messageLength > max {
+		return h.fail(closeStatusTooBigData, ErrMessageTooLarge)
 	}
 	return frame, nil
 }
 
-func (h *hybiFrameHandler) WriteClose(status int) (err error) {
+// validate 按照RFC 6455检查帧报头
+func (h *hybiFrameHandler) validate(header *hybiFrameHeader) error {
+	// RSV只能由协商成功的扩展在消息的第一帧设置
+	allowed := [3]bool{}
+	if header.OpCode == TextFrame || header.OpCode == BinaryFrame {
+		allowed = h.conn.extensionRsv
+	}
+	for i := range header.Rsv {
+		if header.Rsv[i] && !allowed[i] {
+			return ErrReservedBits
+		}
+	}
+
+	switch header.OpCode {
+	case ContinuationFrame:
+		if !h.inMessage {
+			return ErrUnexpectedContinuation
+		}
+	case TextFrame, BinaryFrame:
+		if h.inMessage {
+			return ErrExpectedContinuation
+		}
+	case CloseFrame, PingFrame, PongFrame:
+		// 控制帧不能分片, 载荷不能超过125字节
+		if !header.Fin {
+			return ErrFragmentedControlFrame
+		}
+		if header.Length > maxControlFramePayloadLength {
+			return ErrControlFrameTooLarge
+		}
+	default:
+		return ErrReservedOpCode
+	}
+	return nil
+}
+
+// fail 发送关闭帧并返回err
+func (h *hybiFrameHandler) fail(status int, err error) (frameReader, error) {
+	h.WriteClose(status, "")
+	return nil, err
+}
+
+// 处理对端的关闭帧: 解析状态码和原因, 如果还未发送关闭帧则回复
+func (h *hybiFrameHandler) handleClose(frame frameReader) error {
+	b := make([]byte, maxControlFramePayloadLength)
+	n, err := io.ReadFull(frame, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	io.Copy(ioutil.Discard, frame)
+	h.conn.markCloseReceived()
+
+	closeErr := &CloseError{Code: closeStatusNoStatusRcvd}
+	status := closeStatusNoStatusRcvd
+	switch {
+	case n == 0:
+	case n == 1:
+		status = closeStatusProtocolError
+		closeErr.Code = closeStatusProtocolError
+	default:
+		closeErr.Code = int(binary.BigEndian.Uint16(b))
+		closeErr.Text = string(b[2:n])
+		status = closeErr.Code
+		if !isValidCloseCode(closeErr.Code) {
+			status = closeStatusProtocolError
+		} else if !utf8.Valid(b[2:n]) {
+			status = closeStatusBadMessageData
+		}
+	}
+
+	// 回复关闭帧, 一般使用对端的状态码
+	if err := h.WriteClose(status, ""); err != nil && err != ErrCloseSent {
+		return err
+	}
+	return closeErr
+}
+
+// WriteClose 发送关闭帧, 每个连接只能发送一次
+// status为closeStatusNoStatusRcvd时发送空载荷
+func (h *hybiFrameHandler) WriteClose(status int, reason string) (err error) {
+	var msg []byte
+	if status != closeStatusNoStatusRcvd {
+		if !isValidCloseCode(status) || len(reason) > maxControlFramePayloadLength-2 || !utf8.ValidString(reason) {
+			return ErrBadCloseStatus
+		}
+		msg = make([]byte, 2+len(reason))
+		// 载荷的前两个字节必须是无符号的整数(以网络字节序)
+		// 后续可选内容是utf-8编码的数据, 一般用于调试
+		binary.BigEndian.PutUint16(msg, uint16(status))
+		copy(msg[2:], reason)
+	}
+
 	h.conn.wio.Lock()
 	defer h.conn.wio.Unlock()
+	if h.conn.closeSent {
+		return ErrCloseSent
+	}
 	w, err := h.conn.frameWriterFactory.NewFrameWriter(CloseFrame)
 	if err != nil {
 		return err
 	}
-	msg := make([]byte, 2)
-	// 载荷的前两个字节必须是无符号的整数(以网络字节序)
-	// 后续可选内容是utf-8编码的数据, 一般用于调试
-	binary.BigEndian.PutUint16(msg, uint16(status))
+	h.conn.closeSent = true
 	_, err = w.Write(msg)
 	w.Close()
 	return err
 }
 
-func (h *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
-	h.conn.wio.Lock()
-	defer h.conn.wio.Unlock()
-	w, err := h.conn.frameWriterFactory.NewFrameWriter(PongFrame)
-	if err != nil {
-		return 0, err
+// 可以在关闭帧中发送的状态码
+// 1005, 1006, 1015 只用于本地表示, 不能发送
+func isValidCloseCode(code int) bool {
+	switch code {
+	case closeStatusNormal, closeStatusGoingAway, closeStatusProtocolError,
+		closeStatusUnsupportedData, closeStatusBadMessageData, closeStatusPolicyViolation,
+		closeStatusTooBigData, closeStatusExtensionMismatch, closeStatusInternalError:
+		return true
 	}
-	n, err = w.Write(msg)
-	w.Close()
-	return n, err
+	// 3000-3999 由IANA注册, 4000-4999 供应用私有使用
+	return code >= 3000 && code <= 4999
 }
@@ -0,0 +1,156 @@
+package ws
+
+// 这个文件实现了websocket客户端的握手过程
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hybiClientHandshaker 负责客户端握手
+type hybiClientHandshaker struct {
+	*Config
+	// Sec-WebSocket-Key
+	nonce []byte
+	// 协商成功的扩展及其占用的RSV位
+	extensions   []ExtensionConn
+	extensionRsv [3]bool
+	// 服务端的握手响应
+	resp *http.Response
+}
+
+// 发送客户端握手请求
+// GET /chat HTTP/1.1
+// Host: server.example.com
+// Upgrade: websocket
+// Connection: Upgrade
+// Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==
+// Sec-WebSocket-Protocol: chat, superchat
+// Sec-WebSocket-Version: 13
+func (c *hybiClientHandshaker) WriteHandshake(buf *bufio.Writer) (err error) {
+	if c.Location == nil {
+		return ErrBadLocation
+	}
+	c.Version = ProtocolVersionHybi13
+
+	c.nonce, err = generateNonce()
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString("GET " + c.Location.RequestURI() + " HTTP/1.1\r\n")
+	buf.WriteString("Host: " + c.Location.Host + "\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Key: " + string(c.nonce) + "\r\n")
+	buf.WriteString("Sec-WebSocket-Version: " + SupportedProtocolVersion + "\r\n")
+
+	if c.Origin != nil {
+		buf.WriteString("Origin: " + c.Origin.String() + "\r\n")
+	}
+
+	if len(c.Protocol) > 0 {
+		buf.WriteString("Sec-WebSocket-Protocol: " + strings.Join(c.Protocol, ", ") + "\r\n")
+	}
+
+	if exts := configExtensions(c.Config); len(exts) > 0 {
+		buf.WriteString("Sec-WebSocket-Extensions: " + offerExtensions(exts) + "\r\n")
+	}
+
+	// 发送自定义报头
+	if c.Header != nil {
+		err = c.Header.WriteSubset(buf, handshakeHeaders)
+		if err != nil {
+			return
+		}
+	}
+
+	buf.WriteString("\r\n")
+	return buf.Flush()
+}
+
+// 读取服务端握手响应
+func (c *hybiClientHandshaker) ReadHandshake(buf *bufio.Reader) (err error) {
+	resp, err := http.ReadResponse(buf, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return newStatusError(resp)
+	}
+	c.resp = resp
+
+	if strings.ToLower(resp.Header.Get("Upgrade")) != "websocket" ||
+		!strings.Contains(strings.ToLower(resp.Header.Get("Connection")), "upgrade") {
+		return ErrBadUpgrade
+	}
+
+	// 验证Sec-WebSocket-Accept
+	expectedAccept, err := getNonceAccept(c.nonce)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expectedAccept, []byte(resp.Header.Get("Sec-WebSocket-Accept"))) {
+		return ErrChallengeResponse
+	}
+
+	// 服务端选择的子协议必须是客户端提供的其中一个
+	protocol := strings.TrimSpace(resp.Header.Get("Sec-WebSocket-Protocol"))
+	if protocol != "" {
+		offered := false
+		for _, val := range c.Protocol {
+			if val == protocol {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			return ErrBadWebSocketProtocol
+		}
+		c.Protocol = []string{protocol}
+	} else {
+		c.Protocol = nil
+	}
+
+	// 服务端只能接受客户端提供的扩展
+	c.extensions, c.extensionRsv, err = acceptExtensions(parseExtensions(resp.Header), configExtensions(c.Config))
+	return err
+}
+
+func (c *hybiClientHandshaker) NewClientConn(buf *bufio.ReadWriter, rwc io.ReadWriteCloser) *Conn {
+	conn := newHybiClientConn(c.Config, buf, rwc)
+	conn.setExtensions(c.extensions, c.extensionRsv)
+	conn.handshake = HandshakeInfo{
+		Header:      c.resp.Header,
+		Cookies:     c.resp.Cookies(),
+		Query:       c.Location.Query(),
+		Subprotocol: conn.Subprotocol(),
+		Version:     c.Version,
+		Key:         string(c.nonce),
+	}
+	for _, ext := range parseExtensions(c.resp.Header) {
+		conn.handshake.Extensions = append(conn.handshake.Extensions, formatExtension(ext.name, ext.params))
+	}
+	if tlsConn, ok := rwc.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		conn.handshake.TLS = &state
+	}
+	return conn
+}
+
+// generateNonce 生成Sec-WebSocket-Key: 16字节随机数的base64编码
+func generateNonce() (nonce []byte, err error) {
+	key := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return
+	}
+	nonce = make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	base64.StdEncoding.Encode(nonce, key)
+	return
+}
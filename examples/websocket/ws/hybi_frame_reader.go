@@ -11,6 +11,25 @@ import (
 // 用于创建一个帧读取器
 type hybiFrameReaderFactory struct {
 	*bufio.Reader
+	// 底层连接, 读缓冲为空时可以更换或释放缓冲
+	rwc io.Reader
+	// 读缓冲大小和缓冲池, 参见Config.ReadBufferSize和Config.ReadBufferPool
+	size int
+	pool BufferPool
+	// 释放缓冲后读到的第一个字节
+	first firstReader
+	// 复用的帧读取器, 帧的读取由Conn.rio串行化
+	frame hybiFrameReader
+}
+
+func newHybiFrameReaderFactory(config *Config, br *bufio.Reader, rwc io.Reader) *hybiFrameReaderFactory {
+	return &hybiFrameReaderFactory{
+		Reader: br,
+		rwc:    rwc,
+		size:   config.ReadBufferSize,
+		pool:   config.ReadBufferPool,
+		first:  firstReader{r: rwc},
+	}
 }
 
 //  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
@@ -30,10 +49,15 @@ type hybiFrameReaderFactory struct {
 // + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
 // |                     Payload Data continued ...                |
 // +---------------------------------------------------------------+
-func (buf hybiFrameReaderFactory) NewFrameReader() (frame frameReader, err error) {
-	hybiFrame := new(hybiFrameReader)
+func (buf *hybiFrameReaderFactory) NewFrameReader() (frame frameReader, err error) {
+	if err = buf.prepare(); err != nil {
+		return nil, err
+	}
+	// 上一帧已经读完, 复用帧读取器
+	hybiFrame := &buf.frame
+	*hybiFrame = hybiFrameReader{reader: buf.Reader}
 	frame = hybiFrame
-	var header []byte
+	header := hybiFrame.raw[:0]
 	var b byte
 	// 读取第一个字节， 包含FIN/RSV1/RSV2/RSV3/OpCode(4bits)
 	b, err = buf.ReadByte()
@@ -61,87 +85,103 @@ func (buf hybiFrameReaderFactory) NewFrameReader() (frame frameReader, err error
 	switch {
 	case b <= 125: // payload length 7bits
 		hybiFrame.header.Length = int64(b)
-	case b == 126: // payload length 7 + 16bit, 即随后2个字节用来表示传输速度
+	case b == 126: // payload length 7 + 16bit, 即随后2个字节用来表示载荷长度
 		lengthFields = 2
-	case b == 126: // payload length 7 + 64bit
+	default: // payload length 7 + 64bit
 		lengthFields = 8
 	}
 
 	// 读取payload length
-	for i := 0; i < lengthFields; i++ {
-		b, err = buf.ReadByte()
-		if err != nil {
+	if lengthFields > 0 {
+		if _, err = io.ReadFull(buf.Reader, header[2:2+lengthFields]); err != nil {
 			return
 		}
-
-		if lengthFields == 8 && i == 0 {
+		header = header[:2+lengthFields]
+		if lengthFields == 8 && header[2]&0x80 != 0 {
 			// 当为64bit时，最高有效位(most significant bit) 必须为0
-			b &= 0x7f
+			return nil, ErrBadFrameLength
+		}
+		for _, b := range header[2:] {
+			hybiFrame.header.Length = (hybiFrame.header.Length << 8) + int64(b)
 		}
-
-		header = append(header, b)
-		hybiFrame.header.Length = (hybiFrame.header.Length << 8) + int64(b)
 	}
 
 	// 读取Masking-Key(0-4byte), 只有在mask存在时存在
 	if mask {
-		for i := 0; i < 4; i++ {
-			b, err = buf.ReadByte()
-			if err != nil {
-				return
-			}
-			header = append(header, b)
-			hybiFrame.header.MaskingKey = append(hybiFrame.header.MaskingKey, b)
+		n := len(header)
+		if _, err = io.ReadFull(buf.Reader, header[n:n+4]); err != nil {
+			return
 		}
+		header = header[:n+4]
+		copy(hybiFrame.key[:], header[n:])
+		hybiFrame.header.MaskingKey = hybiFrame.key[:]
 	}
 
-	// 载荷读取器
-	hybiFrame.reader = io.LimitReader(buf.Reader, hybiFrame.header.Length)
-	hybiFrame.header.data = bytes.NewBuffer(header)
-	hybiFrame.length = len(header) + int(hybiFrame.header.Length)
+	hybiFrame.remain = hybiFrame.header.Length
+	hybiFrame.headerLen = len(header)
+	hybiFrame.length = int64(len(header)) + hybiFrame.header.Length
 	return
 }
 
 // frameReader接口的实现
 type hybiFrameReader struct {
-	// 载荷读取器
-	reader io.Reader
+	// 底层读取器
+	reader *bufio.Reader
 	// 帧报头
 	header hybiFrameHeader
+	// 报头原始数据, 最长14字节
+	raw       [maxFrameHeaderSize]byte
+	headerLen int
+	key       [4]byte
+	// 剩余未读取的载荷长度
+	remain int64
 	// 当前读取偏移(主要用于掩码计算)
-	pos int64
+	pos int
 	// 帧大小： 包含报头和载荷
-	length int
+	length int64
 }
 
 func (r *hybiFrameReader) PayloadType() byte {
 	return r.header.OpCode
 }
 
+func (r *hybiFrameReader) fin() bool {
+	return r.header.Fin
+}
+
+func (r *hybiFrameReader) rsv() [3]bool {
+	return r.header.Rsv
+}
+
 func (r *hybiFrameReader) Read(msg []byte) (n int, err error) {
+	if r.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(msg)) > r.remain {
+		msg = msg[:r.remain]
+	}
 	n, err = r.reader.Read(msg)
+	r.remain -= int64(n)
+	if err == io.EOF && r.remain > 0 {
+		// 载荷没有读完连接就断开了, 不能当作分片结束
+		err = io.ErrUnexpectedEOF
+	}
 	// 掩码计算
-	// 第 i byte 数据 = orig-data[i] ^ (i % 4)
+	// 第 i byte 数据 = orig-data[i] ^ key[i % 4]
 	if r.header.MaskingKey != nil {
-		for i := 0; i < n; i++ {
-			msg[i] = msg[i] ^ r.header.MaskingKey[r.pos%4]
-			r.pos++
-		}
+		r.pos = maskBytes(r.key, r.pos, msg[:n])
 	}
 	return n, err
 }
 
 func (r *hybiFrameReader) HeaderReader() io.Reader {
-	if r.header.data == nil {
-		return nil
-	}
-	if r.header.data.Len() == 0 {
+	if r.headerLen == 0 {
 		return nil
 	}
-	return r.header.data
+	return bytes.NewReader(r.raw[:r.headerLen])
 }
 
-func (r *hybiFrameReader) Len() int {
+func (r *hybiFrameReader) Len() int64 {
 	return r.length
 }
 
@@ -10,49 +10,115 @@ import (
 
 // 用于创建一个帧写入器
 type hybiFrameWriterFactory struct {
-	*bufio.Writer
+	// 底层连接
+	rwc io.Writer
+	// 写缓冲大小和缓冲池, 参见Config.WriteBufferSize和Config.WriteBufferPool
+	size           int
+	pool           BufferPool
 	needMaskingKey bool
+	// 复用的帧写入器, 帧的写入由Conn.wio串行化
+	frame hybiFrameWriter
 }
 
-func (fac hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (w frameWriter, err error) {
-	header := &hybiFrameHeader{Fin: true, OpCode: payloadType}
+// 写缓冲总是从池中借用, 未配置WriteBufferPool时使用包级别的池
+func newHybiFrameWriterFactory(config *Config, rwc io.Writer, needMaskingKey bool) *hybiFrameWriterFactory {
+	size := bufferSize(config.WriteBufferSize)
+	pool := config.WriteBufferPool
+	if pool == nil {
+		pool = defaultWriteBufferPool(size)
+	}
+	return &hybiFrameWriterFactory{
+		rwc:            rwc,
+		size:           size,
+		pool:           pool,
+		needMaskingKey: needMaskingKey,
+	}
+}
+
+func (fac *hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (w frameWriter, err error) {
+	return fac.newFragmentWriter(payloadType, true, [3]bool{})
+}
+
+func (fac *hybiFrameWriterFactory) newFragmentWriter(payloadType byte, fin bool, rsv [3]bool) (w frameWriter, err error) {
+	frame := &fac.frame
+	frame.header = hybiFrameHeader{Fin: fin, Rsv: rsv, OpCode: payloadType}
 	if fac.needMaskingKey {
 		// 生成Masking-Key
-		header.MaskingKey, err = generateMaskingKey()
-		if err != nil {
+		if _, err = io.ReadFull(rand.Reader, frame.key[:]); err != nil {
 			return nil, err
 		}
+		frame.header.MaskingKey = frame.key[:]
 	}
-	return &hybiFrameWriter{fac.Writer, header}, nil
+	frame.fac = fac
+	frame.buf = fac.acquire()
+	return frame, nil
 }
 
 type hybiFrameWriter struct {
+	fac    *hybiFrameWriterFactory
 	buf    *bufio.Writer
-	header *hybiFrameHeader
+	header hybiFrameHeader
+	key    [4]byte
+	// 报头在此编码, 避免每帧分配内存
+	raw [maxFrameHeaderSize]byte
 }
 
 // 构造websocket数据帧, 并写入
 func (w *hybiFrameWriter) Write(msg []byte) (n int, err error) {
-	var header []byte
+	length := len(msg)
+	header := appendFrameHeader(w.raw[:0], &w.header, int64(length))
+
+	if w.header.MaskingKey == nil {
+		w.buf.Write(header)
+		w.buf.Write(msg)
+		err = w.buf.Flush()
+		return length, err
+	}
+
+	// MaskingKey
+	header = append(header, w.key[:]...)
+	w.buf.Write(header)
+
+	// 在写缓冲的空闲空间中掩码, 不修改msg, 也不分配内存
+	pos := 0
+	for len(msg) > 0 {
+		if w.buf.Available() == 0 {
+			if err = w.buf.Flush(); err != nil {
+				return n, err
+			}
+		}
+		k := min(len(msg), w.buf.Available())
+		chunk := append(w.buf.AvailableBuffer(), msg[:k]...)
+		pos = maskBytes(w.key, pos, chunk)
+		w.buf.Write(chunk)
+		msg = msg[k:]
+		n += k
+	}
+	err = w.buf.Flush()
+	return length, err
+}
+
+// appendFrameHeader 将帧头(不含Masking-Key)追加到dst
+func appendFrameHeader(dst []byte, h *hybiFrameHeader, length int64) []byte {
 	var b byte
 	// Fin
-	if w.header.Fin {
+	if h.Fin {
 		b = 1 << 7
 	}
 
 	// RSV*
 	for i := 0; i < 3; i++ {
-		if w.header.Rsv[i] {
+		if h.Rsv[i] {
 			b |= 1 << uint(6-i)
 		}
 	}
 
 	// OpCode
-	b |= w.header.OpCode
-	header = append(header, b)
+	b |= h.OpCode
+	dst = append(dst, b)
 
 	// Mask
-	if w.header.MaskingKey != nil {
+	if h.MaskingKey != nil {
 		b = 1 << 7
 	} else {
 		b = 0
@@ -60,7 +126,6 @@ func (w *hybiFrameWriter) Write(msg []byte) (n int, err error) {
 
 	// payload length
 	lengthField := 0
-	length := len(msg)
 	switch {
 	case length <= 125:
 		b |= byte(length)
@@ -71,47 +136,22 @@ func (w *hybiFrameWriter) Write(msg []byte) (n int, err error) {
 		b |= 127
 		lengthField = 8 // + 64bit
 	}
-	header = append(header, b)
+	dst = append(dst, b)
 
 	// extention payload length
 	for i := 0; i < lengthField; i++ {
 		j := uint((lengthField - i - 1) * 8)
 		b = byte((length >> j) & 0xff)
-		header = append(header, b)
+		dst = append(dst, b)
 	}
-
-	// MaskingKey
-	if w.header.MaskingKey != nil {
-		if len(w.header.MaskingKey) != 4 {
-			return 0, ErrBadMaskingKey
-		}
-		header = append(header, w.header.MaskingKey...)
-
-		// 写入头部
-		w.buf.Write(header)
-		// 掩码
-		data := make([]byte, length)
-		for i := range data {
-			data[i] = msg[i] ^ w.header.MaskingKey[i%4]
-		}
-		w.buf.Write(data)
-		err = w.buf.Flush()
-		return length, err
-	}
-
-	w.buf.Write(header)
-	w.buf.Write(msg)
-	err = w.buf.Flush()
-	return length, err
+	return dst
 }
 
+// Close 归还写缓冲
 func (w *hybiFrameWriter) Close() error {
+	if w.buf != nil {
+		w.fac.release(w.buf)
+		w.buf = nil
+	}
 	return nil
 }
-
-// generateMaskingKey 生成4个字节的随机字符串
-func generateMaskingKey() (maskingKey []byte, err error) {
-	maskingKey = make([]byte, 4)
-	_, err = io.ReadFull(rand.Reader, maskingKey)
-	return
-}
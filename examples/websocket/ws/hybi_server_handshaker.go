@@ -17,10 +17,21 @@ import (
 type hybiServerHandshaker struct {
 	*Config
 	accept []byte
+	// Sec-WebSocket-Key
+	key string
+	// 认证得到的principal
+	principal interface{}
+	// 没有协商子协议时在响应中回显的凭证子协议, 不作为连接的子协议
+	echoProtocol string
+	// 协商成功的扩展及其占用的RSV位
+	extensions   []ExtensionConn
+	extensionRsv [3]bool
+	// Sec-WebSocket-Extensions 响应中的各项
+	extensionResponse []string
 }
 
 // 读取客户端握手数据
-func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Request) (code int, err error) {
+func (c *hybiServerHandshaker) ReadHandshake(req *http.Request) (code int, err error) {
 	c.Version = ProtocolVersionHybi13
 	// websocket 必须有GET发起
 	if req.Method != http.MethodGet {
@@ -62,8 +73,18 @@ func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Reques
 		return http.StatusBadRequest, err
 	}
 
+	// 浏览器总会发送Origin, 其他客户端可能没有
+	c.Origin = nil
+	if origin := req.Header.Get("Origin"); origin != "" {
+		c.Origin, err = url.ParseRequestURI(origin)
+		if err != nil {
+			return http.StatusForbidden, ErrBadOrigin
+		}
+	}
+
 	// Sec-WebSocket-Protocol如果存在， 表示客户端希望交互的子协议
 	protocol := strings.TrimSpace(req.Header.Get("Sec-WebSocket-Protocol"))
+	c.Protocol = nil
 	if protocol != "" {
 		protocols := strings.Split(protocol, ",")
 		for _, val := range protocols {
@@ -71,6 +92,12 @@ func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Reques
 		}
 	}
 
+	// Sec-WebSocket-Extensions 表示客户端希望使用的扩展
+	if exts := configExtensions(c.Config); len(exts) > 0 {
+		c.extensions, c.extensionRsv, c.extensionResponse = negotiateExtensions(parseExtensions(req.Header), exts)
+	}
+
+	c.key = key
 	c.accept, err = getNonceAccept([]byte(key))
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -82,7 +109,7 @@ func (c *hybiServerHandshaker) ReadHandshake(buf *bufio.Reader, req *http.Reques
 // 接受websocket
 func (c *hybiServerHandshaker) AcceptHandshake(buf *bufio.Writer) (err error) {
 	if len(c.Protocol) > 0 && len(c.Protocol) != 1 {
-		// 服务端必须从子协议中选择一个，这个行为在Server中自定义
+		// 服务端最多只能选择一个子协议，这个行为在Server中自定义
 		return ErrBadWebSocketProtocol
 	}
 	code := http.StatusSwitchingProtocols
@@ -93,6 +120,12 @@ func (c *hybiServerHandshaker) AcceptHandshake(buf *bufio.Writer) (err error) {
 
 	if len(c.Protocol) > 0 {
 		buf.WriteString("Sec-WebSocket-Protocol: " + c.Protocol[0] + "\r\n")
+	} else if c.echoProtocol != "" {
+		buf.WriteString("Sec-WebSocket-Protocol: " + c.echoProtocol + "\r\n")
+	}
+
+	if len(c.extensionResponse) > 0 {
+		buf.WriteString("Sec-WebSocket-Extensions: " + strings.Join(c.extensionResponse, ", ") + "\r\n")
 	}
 
 	// 发送自定义报头
@@ -108,7 +141,20 @@ func (c *hybiServerHandshaker) AcceptHandshake(buf *bufio.Writer) (err error) {
 }
 
 func (c *hybiServerHandshaker) NewServerConn(buf *bufio.ReadWriter, rwc io.ReadWriteCloser, req *http.Request) *Conn {
-	return newHybiServerConn(c.Config, buf, rwc, req)
+	conn := newHybiServerConn(c.Config, buf, rwc, req)
+	conn.setExtensions(c.extensions, c.extensionRsv)
+	conn.principal = c.principal
+	conn.handshake = HandshakeInfo{
+		Header:      req.Header,
+		Cookies:     req.Cookies(),
+		Query:       req.URL.Query(),
+		Subprotocol: conn.Subprotocol(),
+		Extensions:  c.extensionResponse,
+		Version:     c.Version,
+		Key:         c.key,
+		TLS:         req.TLS,
+	}
+	return conn
 }
 
 // 生成accept值
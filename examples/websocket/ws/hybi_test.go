@@ -0,0 +1,364 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	rsv1 = 0x40
+	rsv2 = 0x20
+	rsv3 = 0x10
+)
+
+var testMaskingKey = [4]byte{0x37, 0xfa, 0x21, 0x3d}
+
+// rawFrame 按RFC 6455编码一个帧, 不使用包内的编码器
+func rawFrame(fin bool, rsv, opCode byte, masked bool, payload []byte) []byte {
+	b0 := rsv | opCode
+	if fin {
+		b0 |= 0x80
+	}
+	var b1 byte
+	if masked {
+		b1 = 0x80
+	}
+	frame := []byte{b0, b1}
+	switch n := len(payload); {
+	case n <= 125:
+		frame[1] |= byte(n)
+	case n < 65536:
+		frame[1] |= 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] |= 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	frame = append(frame, testMaskingKey[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^testMaskingKey[i%4])
+	}
+	return frame
+}
+
+// clientFrame 返回客户端发送的掩码帧
+func clientFrame(fin bool, opCode byte, payload string) []byte {
+	return rawFrame(fin, 0, opCode, true, []byte(payload))
+}
+
+func closePayload(code int) string {
+	return string(binary.BigEndian.AppendUint16(nil, uint16(code)))
+}
+
+// closeCode 从服务端写出的数据中找到关闭帧, 返回其中的状态码, 没有关闭帧时返回0
+func closeCode(t *testing.T, out []byte) int {
+	for len(out) >= 2 {
+		opCode := out[0] & 0x0f
+		length, header := int(out[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(out[2:])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(out[2:])), 10
+		}
+		if out[1]&0x80 != 0 {
+			t.Fatalf("server frame is masked: % x", out)
+		}
+		payload := out[header : header+length]
+		if opCode == CloseFrame {
+			if len(payload) < 2 {
+				return closeStatusNoStatusRcvd
+			}
+			return int(binary.BigEndian.Uint16(payload))
+		}
+		out = out[header+length:]
+	}
+	return 0
+}
+
+// rawConn 从in读取, 写出的数据记录在out中
+type rawConn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *rawConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *rawConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *rawConn) Close() error                { return nil }
+
+// readTest 是服务端读取一组原始帧的测试用例
+type readTest struct {
+	name   string
+	config Config
+	frames [][]byte
+	// 按顺序读到的消息
+	want []string
+	err  error
+	// 服务端发送的关闭帧的状态码
+	code int
+}
+
+// testServerRead 将原始帧交给服务端连接读取, 检查读到的消息, 错误和回复的关闭帧
+// 没有指定错误时, 在最后追加对端的1000关闭帧
+func testServerRead(t *testing.T, tests []readTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in bytes.Buffer
+			for _, frame := range tt.frames {
+				in.Write(frame)
+			}
+			wantErr, wantCode := tt.err, tt.code
+			if wantErr == nil {
+				// 正常结束时由对端关闭
+				in.Write(clientFrame(true, CloseFrame, closePayload(closeStatusNormal)))
+				wantErr = &CloseError{Code: closeStatusNormal}
+				wantCode = closeStatusNormal
+			}
+			rwc := &rawConn{in: &in}
+			config := tt.config
+			c := newHybiConn(&config, nil, rwc, &http.Request{})
+
+			var got []string
+			var err error
+			for {
+				var p []byte
+				if _, p, err = c.ReadMessage(); err != nil {
+					break
+				}
+				got = append(got, string(p))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(err, wantErr) {
+				t.Errorf("err = %v, want %v", err, wantErr)
+			}
+			if code := closeCode(t, rwc.out.Bytes()); code != wantCode {
+				t.Errorf("close code = %d, want %d", code, wantCode)
+			}
+		})
+	}
+}
+
+func TestFrameLength(t *testing.T) {
+	mb := strings.Repeat("x", 70000)
+	testServerRead(t, []readTest{
+		{
+			name:   "16-bit length",
+			frames: [][]byte{clientFrame(true, BinaryFrame, mb[:300])},
+			want:   []string{mb[:300]},
+		},
+		{
+			name:   "64-bit length",
+			frames: [][]byte{clientFrame(true, BinaryFrame, mb)},
+			want:   []string{mb},
+		},
+		{
+			name:   "64-bit length with msb set",
+			frames: [][]byte{{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}},
+			err:    ErrBadFrameLength,
+			code:   closeStatusProtocolError,
+		},
+	})
+}
+
+func TestWriteFrameLength(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{65535, []byte{0x82, 126, 0xff, 0xff}},
+		{65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		rwc := &rawConn{in: strings.NewReader("")}
+		c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+		if err := c.WriteMessage(BinaryFrame, make([]byte, tt.length)); err != nil {
+			t.Fatal(err)
+		}
+		out := rwc.out.Bytes()
+		if !bytes.HasPrefix(out, tt.header) || len(out) != len(tt.header)+tt.length {
+			t.Errorf("length %d: header % x, %d bytes, want % x", tt.length, out[:min(len(out), 10)], len(out), tt.header)
+		}
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	testServerRead(t, []readTest{
+		{
+			name:   "unmasked client frame",
+			frames: [][]byte{rawFrame(true, 0, TextFrame, false, []byte("hi"))},
+			err:    ErrMaskRequired,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "rsv1 without extension",
+			frames: [][]byte{rawFrame(true, rsv1, TextFrame, true, []byte("hi"))},
+			err:    ErrReservedBits,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "rsv2",
+			frames: [][]byte{rawFrame(true, rsv2, BinaryFrame, true, nil)},
+			err:    ErrReservedBits,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "rsv3 on ping",
+			frames: [][]byte{rawFrame(true, rsv3, PingFrame, true, nil)},
+			err:    ErrReservedBits,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "reserved data opcode",
+			frames: [][]byte{clientFrame(true, 3, "")},
+			err:    ErrReservedOpCode,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "reserved control opcode",
+			frames: [][]byte{clientFrame(true, 0xb, "")},
+			err:    ErrReservedOpCode,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{clientFrame(false, PingFrame, "")},
+			err:    ErrFragmentedControlFrame,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "ping over 125 bytes",
+			frames: [][]byte{clientFrame(true, PingFrame, strings.Repeat("x", 126))},
+			err:    ErrControlFrameTooLarge,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name:   "continuation without message",
+			frames: [][]byte{clientFrame(true, ContinuationFrame, "x")},
+			err:    ErrUnexpectedContinuation,
+			code:   closeStatusProtocolError,
+		},
+		{
+			name: "new message while fragmented",
+			frames: [][]byte{
+				clientFrame(false, TextFrame, "a"),
+				clientFrame(true, TextFrame, "b"),
+			},
+			err:  ErrExpectedContinuation,
+			code: closeStatusProtocolError,
+		},
+		{
+			name:   "invalid utf-8",
+			frames: [][]byte{clientFrame(true, TextFrame, "a\xffb")},
+			err:    ErrInvalidUTF8,
+			code:   closeStatusBadMessageData,
+		},
+		{
+			name: "utf-8 split across fragments",
+			frames: [][]byte{
+				clientFrame(false, TextFrame, "\xe2"),
+				clientFrame(false, ContinuationFrame, "\x82"),
+				clientFrame(true, ContinuationFrame, "\xac"),
+			},
+			want: []string{"€"},
+		},
+		{
+			name: "invalid utf-8 across fragments",
+			frames: [][]byte{
+				clientFrame(false, TextFrame, "\xe2\x82"),
+				clientFrame(true, ContinuationFrame, "("),
+			},
+			err:  ErrInvalidUTF8,
+			code: closeStatusBadMessageData,
+		},
+		{
+			name:   "truncated utf-8 at end of message",
+			frames: [][]byte{clientFrame(true, TextFrame, "\xe2\x82")},
+			err:    ErrInvalidUTF8,
+			code:   closeStatusBadMessageData,
+		},
+		{
+			name:   "invalid utf-8 in binary message",
+			frames: [][]byte{clientFrame(true, BinaryFrame, "\xff")},
+			want:   []string{"\xff"},
+		},
+		{
+			name:   "non-strict mode",
+			config: Config{DisableStrictMode: true},
+			frames: [][]byte{rawFrame(true, rsv2, TextFrame, true, []byte("\xff"))},
+			want:   []string{"\xff"},
+		},
+	})
+}
+
+func TestPayloadLimits(t *testing.T) {
+	mb := strings.Repeat("x", 70000)
+	testServerRead(t, []readTest{
+		{
+			name:   "frame too large",
+			config: Config{MaxPayloadBytes: 10},
+			frames: [][]byte{clientFrame(true, BinaryFrame, mb[:11])},
+			err:    ErrFrameTooLarge,
+			code:   closeStatusTooBigData,
+		},
+		{
+			name:   "message too large",
+			config: Config{MaxPayloadBytes: 10, MaxFramePayloadBytes: -1},
+			frames: [][]byte{
+				clientFrame(false, BinaryFrame, mb[:6]),
+				clientFrame(true, ContinuationFrame, mb[:6]),
+			},
+			err:  ErrMessageTooLarge,
+			code: closeStatusTooBigData,
+		},
+		{
+			name:   "message at limit",
+			config: Config{MaxPayloadBytes: 12, MaxFramePayloadBytes: -1},
+			frames: [][]byte{
+				clientFrame(false, BinaryFrame, mb[:6]),
+				clientFrame(true, ContinuationFrame, mb[:6]),
+			},
+			want: []string{mb[:12]},
+		},
+		{
+			name:   "unlimited",
+			config: Config{MaxPayloadBytes: -1},
+			frames: [][]byte{clientFrame(true, BinaryFrame, mb)},
+			want:   []string{mb},
+		},
+	})
+}
+
+func TestClientRejectsMaskedFrame(t *testing.T) {
+	rwc := &rawConn{in: bytes.NewReader(rawFrame(true, 0, TextFrame, true, []byte("hi")))}
+	c := newHybiConn(&Config{}, nil, rwc, nil)
+	if _, _, err := c.ReadMessage(); err != ErrUnexpectedMask {
+		t.Fatalf("err = %v, want %v", err, ErrUnexpectedMask)
+	}
+	if code := closeCode(t, unmask(t, rwc.out.Bytes())); code != closeStatusProtocolError {
+		t.Fatalf("close code = %d, want %d", code, closeStatusProtocolError)
+	}
+}
+
+// unmask 去掉客户端写出的单个帧的掩码
+func unmask(t *testing.T, frame []byte) []byte {
+	if len(frame) < 6 || frame[1]&0x80 == 0 || frame[1]&0x7f > 125 {
+		t.Fatalf("unexpected client frame: % x", frame)
+	}
+	var key [4]byte
+	copy(key[:], frame[2:6])
+	payload := append([]byte(nil), frame[6:]...)
+	maskBytes(key, 0, payload)
+	return append([]byte{frame[0], frame[1] &^ 0x80}, payload...)
+}
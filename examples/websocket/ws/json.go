@@ -0,0 +1,78 @@
+package ws
+
+// 这个文件实现了JSON消息的读写
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ReadJSON 读取下一条消息并解码到v, 消息不会被完整缓冲
+func (c *Conn) ReadJSON(v interface{}) error {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	er := &errReader{r: r}
+	err = json.NewDecoder(er).Decode(v)
+	if err == nil {
+		return nil
+	}
+	if er.err != nil && er.err != io.EOF {
+		return er.err
+	}
+	if err == io.EOF {
+		// 空消息
+		err = io.ErrUnexpectedEOF
+	}
+	return &DecodeError{Err: err}
+}
+
+// WriteJSON 将v编码为JSON, 作为一条TextFrame消息发送
+// 编码失败时不会发送任何数据
+func (c *Conn) WriteJSON(v interface{}) error {
+	w := &lazyWriter{conn: c, messageType: TextFrame}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		if w.w != nil {
+			w.w.Close()
+		}
+		return err
+	}
+	return w.Close()
+}
+
+// errReader 记录读取器返回的错误, 用于区分连接错误和解码错误
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// lazyWriter 在第一次写入时才创建消息写入器
+type lazyWriter struct {
+	conn        *Conn
+	messageType byte
+	w           io.WriteCloser
+}
+
+func (w *lazyWriter) Write(p []byte) (n int, err error) {
+	if w.w == nil {
+		w.w = w.conn.newWriter(w.messageType)
+	}
+	return w.w.Write(p)
+}
+
+// Close 发送消息, 没有写入数据时发送空消息
+func (w *lazyWriter) Close() error {
+	if w.w == nil {
+		return w.conn.WriteMessage(w.messageType, nil)
+	}
+	return w.w.Close()
+}
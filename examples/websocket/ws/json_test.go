@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJSON(t *testing.T) {
+	type message struct {
+		Name  string
+		Count int
+	}
+	tests := []struct {
+		name string
+		data string
+		want message
+		// 期望*DecodeError包装的错误, 为nil表示解码成功
+		err error
+	}{
+		{
+			name: "valid",
+			data: `{"Name":"a","Count":1}`,
+			want: message{Name: "a", Count: 1},
+		},
+		{
+			name: "syntax error",
+			data: `{"Name" 1}`,
+			err:  &json.SyntaxError{},
+		},
+		{
+			name: "truncated",
+			data: `{"Name":`,
+			err:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "wrong type",
+			data: `{"Count":"x"}`,
+			err:  &json.UnmarshalTypeError{},
+		},
+		{
+			name: "empty message",
+			err:  io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := clientFrame(true, TextFrame, tt.data)
+			// 解码失败后连接仍然可用
+			frames = append(frames, clientFrame(true, TextFrame, "next")...)
+			rwc := &rawConn{in: strings.NewReader(string(frames))}
+			c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+
+			var got message
+			err := c.ReadJSON(&got)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("got %+v, want %+v", got, tt.want)
+				}
+			} else {
+				var de *DecodeError
+				if !errors.As(err, &de) {
+					t.Fatalf("err = %v, want *DecodeError", err)
+				}
+				// 结构体错误只比较类型
+				if reflect.TypeOf(de.Err) != reflect.TypeOf(tt.err) || (tt.err == io.ErrUnexpectedEOF && de.Err != tt.err) {
+					t.Errorf("DecodeError.Err = %#v, want %T", de.Err, tt.err)
+				}
+			}
+			if _, p, err := c.ReadMessage(); err != nil || string(p) != "next" {
+				t.Errorf("next message: %q, %v", p, err)
+			}
+		})
+	}
+}
+
+func TestReadJSONCloseError(t *testing.T) {
+	rwc := &rawConn{in: strings.NewReader(string(clientFrame(true, CloseFrame, closePayload(CloseGoingAway))))}
+	c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+	var v interface{}
+	// 连接上的错误不是解码错误
+	want := &CloseError{Code: CloseGoingAway}
+	if err := c.ReadJSON(&v); !reflect.DeepEqual(err, want) {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	rwc := &rawConn{in: strings.NewReader("")}
+	c := newHybiConn(&Config{}, nil, rwc, &http.Request{})
+
+	// 编码失败时不发送数据
+	if err := c.WriteJSON(make(chan int)); err == nil {
+		t.Fatal("encoded a channel")
+	}
+	if rwc.out.Len() != 0 {
+		t.Fatalf("wrote %d bytes after encoding failure", rwc.out.Len())
+	}
+
+	if err := c.WriteJSON(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0x81, 8}, `{"a":1}`+"\n"...)
+	if got := rwc.out.Bytes(); string(got) != string(want) {
+		t.Errorf("wrote % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package ws
+
+// 这个文件实现了连接数限制和握手请求的限速
+// 客户端IP按TrustedProxies解析, 所有限制都在劫持连接之前检查
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTooManyConns 表示连接数达到Server.MaxConns, 以503拒绝握手
+	ErrTooManyConns = &ProtocolError{"too many connections"}
+	// ErrTooManyConnsPerIP 表示客户端IP的连接数达到Server.MaxConnsPerIP, 以429拒绝握手
+	ErrTooManyConnsPerIP = &ProtocolError{"too many connections from this address"}
+	// ErrRateLimited 表示客户端IP的握手请求超过了Server.UpgradeRate, 以429拒绝握手
+	ErrRateLimited = &ProtocolError{"too many upgrade requests"}
+)
+
+const (
+	// 连接数超限时建议客户端重试的间隔
+	connLimitRetryAfter = time.Second
+	// 清理空闲令牌桶的间隔
+	bucketSweepInterval = time.Minute
+)
+
+// ServerStats 是服务端的连接数和拒绝次数统计
+type ServerStats struct {
+	// 当前的连接数, 包括正在握手的连接
+	Conns int
+	// 因MaxConns, MaxConnsPerIP和UpgradeRate拒绝的握手次数
+	RejectedMaxConns      uint64
+	RejectedMaxConnsPerIP uint64
+	RejectedRate          uint64
+}
+
+// limitState 保存限制相关的状态, 由Server.limitMu保护
+type limitState struct {
+	conns     int
+	connsByIP map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	rejectedMaxConns      atomic.Uint64
+	rejectedMaxConnsPerIP atomic.Uint64
+	rejectedRate          atomic.Uint64
+}
+
+// tokenBucket 是一个客户端IP的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Stats 返回连接数和拒绝次数统计
+func (s *Server) Stats() ServerStats {
+	s.limitMu.Lock()
+	conns := s.limits.conns
+	s.limitMu.Unlock()
+	return ServerStats{
+		Conns:                 conns,
+		RejectedMaxConns:      s.limits.rejectedMaxConns.Load(),
+		RejectedMaxConnsPerIP: s.limits.rejectedMaxConnsPerIP.Load(),
+		RejectedRate:          s.limits.rejectedRate.Load(),
+	}
+}
+
+// limitKey 返回用于限制的客户端IP
+func (s *Server) limitKey(req *http.Request) string {
+	ip := clientIP(stringAddr(req.RemoteAddr), req, s.trustedProxies())
+	if ip == nil {
+		return req.RemoteAddr
+	}
+	return ip.String()
+}
+
+// allowUpgrade 从客户端IP的令牌桶中取出一个令牌, 失败时返回需要等待的时间
+func (s *Server) allowUpgrade(ip string) (retryAfter time.Duration, ok bool) {
+	if s.UpgradeRate <= 0 {
+		return 0, true
+	}
+	burst := float64(s.UpgradeBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+	s.sweepBuckets(now, burst)
+	if s.limits.buckets == nil {
+		s.limits.buckets = make(map[string]*tokenBucket)
+	}
+	b := s.limits.buckets[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		s.limits.buckets[ip] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*s.UpgradeRate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	s.limits.rejectedRate.Add(1)
+	return time.Duration((1 - b.tokens) / s.UpgradeRate * float64(time.Second)), false
+}
+
+// sweepBuckets 删除已经装满的令牌桶, 需要持有limitMu
+func (s *Server) sweepBuckets(now time.Time, burst float64) {
+	if now.Sub(s.limits.lastSweep) < bucketSweepInterval {
+		return
+	}
+	s.limits.lastSweep = now
+	for ip, b := range s.limits.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*s.UpgradeRate >= burst {
+			delete(s.limits.buckets, ip)
+		}
+	}
+}
+
+// acquireConn 占用一个连接名额, 连接结束后调用release归还
+func (s *Server) acquireConn(ip string) (release func(), code int, err error) {
+	s.limitMu.Lock()
+	defer s.limitMu.Unlock()
+	if s.MaxConns > 0 && s.limits.conns >= s.MaxConns {
+		s.limits.rejectedMaxConns.Add(1)
+		return nil, http.StatusServiceUnavailable, ErrTooManyConns
+	}
+	if s.MaxConnsPerIP > 0 && s.limits.connsByIP[ip] >= s.MaxConnsPerIP {
+		s.limits.rejectedMaxConnsPerIP.Add(1)
+		return nil, http.StatusTooManyRequests, ErrTooManyConnsPerIP
+	}
+	if s.limits.connsByIP == nil {
+		s.limits.connsByIP = make(map[string]int)
+	}
+	s.limits.conns++
+	s.limits.connsByIP[ip]++
+	return func() {
+		s.limitMu.Lock()
+		defer s.limitMu.Unlock()
+		s.limits.conns--
+		if s.limits.connsByIP[ip]--; s.limits.connsByIP[ip] <= 0 {
+			delete(s.limits.connsByIP, ip)
+		}
+	}, http.StatusSwitchingProtocols, nil
+}
+
+// rejectRetry 拒绝握手, 并通过Retry-After告知客户端重试的时间(秒, 向上取整)
+func (s *Server) rejectRetry(w http.ResponseWriter, req *http.Request, status int, retryAfter time.Duration, reason error) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	s.reject(w, req, status, reason)
+}
+
+// stringAddr 是http.Request.RemoteAddr表示的地址
+type stringAddr string
+
+func (addr stringAddr) Network() string { return "tcp" }
+
+func (addr stringAddr) String() string { return string(addr) }
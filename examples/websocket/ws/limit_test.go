@@ -0,0 +1,109 @@
+package ws
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConnLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+		// 第二个连接的另一个客户端IP, 为空时与第一个相同
+		forwarded string
+		status    int
+		reason    error
+	}{
+		{
+			name:   "max conns",
+			server: &Server{MaxConns: 1},
+			status: http.StatusServiceUnavailable,
+			reason: ErrTooManyConns,
+		},
+		{
+			name:   "max conns per ip",
+			server: &Server{MaxConnsPerIP: 1},
+			status: http.StatusTooManyRequests,
+			reason: ErrTooManyConnsPerIP,
+		},
+		{
+			name:      "max conns across ips",
+			server:    &Server{MaxConns: 1, TrustedProxies: []string{"127.0.0.1"}},
+			forwarded: "10.0.0.1",
+			status:    http.StatusServiceUnavailable,
+			reason:    ErrTooManyConns,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			s.Handler = func(c *Conn) {
+				for {
+					if _, _, err := c.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}
+			var rejected error
+			s.OnReject = func(req *http.Request, status int, reason error) { rejected = reason }
+			srv, url := newTestServer(t, s)
+
+			c, err := Dial(url, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := make(http.Header)
+			if tt.forwarded != "" {
+				header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			resp := upgrade(t, srv, header)
+			if resp.StatusCode != tt.status || resp.Header.Get("Retry-After") != "1" {
+				t.Errorf("over limit: status %d, Retry-After %q, want %d, \"1\"", resp.StatusCode, resp.Header.Get("Retry-After"), tt.status)
+			}
+			if rejected != tt.reason {
+				t.Errorf("rejected with %v, want %v", rejected, tt.reason)
+			}
+			stats := s.Stats()
+			if stats.Conns != 1 || stats.RejectedMaxConns+stats.RejectedMaxConnsPerIP != 1 {
+				t.Errorf("stats = %+v", stats)
+			}
+
+			// 关闭的连接释放名额
+			c.Close()
+			waitFor(t, "slot release", func() bool { return s.Stats().Conns == 0 })
+			if resp := upgrade(t, srv, header); resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Errorf("after close: status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+		})
+	}
+}
+
+func TestUpgradeRate(t *testing.T) {
+	s := &Server{
+		UpgradeRate:    0.5,
+		UpgradeBurst:   2,
+		TrustedProxies: []string{"127.0.0.1"},
+		Handler:        func(c *Conn) {},
+	}
+	srv, _ := newTestServer(t, s)
+
+	for i := 0; i < 2; i++ {
+		if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("upgrade %d within burst: status %d", i, resp.StatusCode)
+		}
+	}
+	// 一个令牌需要2秒
+	resp := upgrade(t, srv, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("over rate: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if n := s.Stats().RejectedRate; n != 1 {
+		t.Errorf("RejectedRate = %d, want 1", n)
+	}
+
+	// 每个客户端IP有自己的令牌桶
+	header := http.Header{"X-Forwarded-For": {"10.0.0.1"}}
+	if resp := upgrade(t, srv, header); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("another client: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,32 @@
+package ws
+
+// 这个文件实现了载荷的掩码计算
+
+import (
+	"encoding/binary"
+)
+
+// maskBytes 用key对b原地异或, pos为b在载荷中的偏移(模4), 返回下一段数据的偏移
+// 先逐字节对齐到key的起始位置, 然后每次处理8个字节
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	pos &= 3
+	for len(b) > 0 && pos != 0 {
+		b[0] ^= key[pos]
+		b = b[1:]
+		pos = (pos + 1) & 3
+	}
+
+	if len(b) >= 8 {
+		k := uint64(binary.LittleEndian.Uint32(key[:]))
+		k |= k << 32
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^k)
+			b = b[8:]
+		}
+	}
+
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+	return (pos + len(b)) & 3
+}
@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+)
+
+func maskBytesNaive(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[(pos+i)%4]
+	}
+	return (pos + len(b)) % 4
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for pos := 0; pos < 4; pos++ {
+		for n := 0; n <= 17; n++ {
+			// 从缓冲中间开始, 数据不按8字节对齐
+			for off := 0; off < 8; off++ {
+				buf := make([]byte, off+n)
+				for i := range buf {
+					buf[i] = byte(i * 7)
+				}
+				want := append([]byte(nil), buf[off:]...)
+				wantPos := maskBytesNaive(key, pos, want)
+				got := buf[off:]
+				gotPos := maskBytes(key, pos, got)
+				if !bytes.Equal(got, want) || gotPos != wantPos {
+					t.Errorf("pos=%d len=%d off=%d: got % x (pos %d), want % x (pos %d)",
+						pos, n, off, got, gotPos, want, wantPos)
+				}
+			}
+		}
+	}
+}
+
+func TestMaskBytesSplit(t *testing.T) {
+	key := [4]byte{0xa1, 0xb2, 0xc3, 0xd4}
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	want := append([]byte(nil), data...)
+	maskBytesNaive(key, 0, want)
+	// 分段掩码的结果与一次掩码相同
+	for split := 0; split <= len(data); split++ {
+		got := append([]byte(nil), data...)
+		pos := maskBytes(key, 0, got[:split])
+		maskBytes(key, pos, got[split:])
+		if !bytes.Equal(got, want) {
+			t.Fatalf("split=%d: got % x, want % x", split, got, want)
+		}
+	}
+}
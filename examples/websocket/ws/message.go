@@ -0,0 +1,222 @@
+package ws
+
+// 这个文件实现了面向消息的读写接口
+// 一条消息由一个或多个帧组成: 第一帧为TextFrame或BinaryFrame, 后续为ContinuationFrame, 最后一帧设置Fin
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// 消息写入器的缓冲大小, 缓冲满时将作为一个分片发送
+	defaultWriteFrameSize = 4096
+)
+
+var (
+	// ErrBadMessageType 表示消息类型不是TextFrame或BinaryFrame
+	ErrBadMessageType = &ProtocolError{"bad message type"}
+	// ErrWriterClosed 表示消息写入器已经关闭
+	ErrWriterClosed = &ProtocolError{"message writer closed"}
+)
+
+// NextReader 返回下一条消息的类型和读取器, 读取器会跨越分片直到Fin帧, 读完后返回io.EOF
+// 调用NextReader会丢弃上一条消息未读取的数据, 之前返回的读取器随即失效
+func (c *Conn) NextReader() (messageType byte, r io.Reader, err error) {
+	// 读完上一条消息, 保证压缩上下文同步
+	if c.reader != nil {
+		io.Copy(ioutil.Discard, c.reader)
+		c.reader = nil
+	}
+
+	c.rio.Lock()
+	if c.readErr != nil {
+		c.rio.Unlock()
+		return 0, nil, c.readErr
+	}
+
+	// 丢弃上一条消息剩余的数据
+	for c.frameReader != nil || !c.readFin {
+		if c.frameReader != nil {
+			io.Copy(ioutil.Discard, c.frameReader)
+			c.frameReader = nil
+		}
+		if !c.readFin {
+			if err = c.nextFrame(); err != nil {
+				c.rio.Unlock()
+				return 0, nil, err
+			}
+		}
+	}
+
+	if err = c.nextFrame(); err != nil {
+		c.rio.Unlock()
+		return 0, nil, err
+	}
+	c.readSeq++
+	messageType = c.frameReader.PayloadType()
+	rsv := c.frameReader.rsv()
+	r = &messageReader{conn: c, seq: c.readSeq}
+	c.rio.Unlock()
+
+	if len(c.extensions) > 0 {
+		r = c.wrapReader(r, rsv)
+	}
+	if !c.config.DisableStrictMode && messageType == TextFrame {
+		r = &utf8Reader{conn: c, r: r}
+	}
+	c.reader = r
+	return messageType, r, nil
+}
+
+// ReadMessage 读取一条完整的消息
+func (c *Conn) ReadMessage() (messageType byte, p []byte, err error) {
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	p, err = ioutil.ReadAll(r)
+	return messageType, p, err
+}
+
+// messageReader 读取一条消息的载荷
+type messageReader struct {
+	conn *Conn
+	seq  uint64
+}
+
+func (r *messageReader) Read(msg []byte) (n int, err error) {
+	c := r.conn
+	c.rio.Lock()
+	defer c.rio.Unlock()
+	if r.seq != c.readSeq {
+		return 0, io.EOF
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	for {
+		if c.frameReader == nil {
+			if c.readFin {
+				return 0, io.EOF
+			}
+			if err = c.nextFrame(); err != nil {
+				return 0, err
+			}
+		}
+		n, err = c.frameReader.Read(msg)
+		if err == io.EOF {
+			// 当前分片已读完
+			c.frameReader = nil
+			err = nil
+		}
+		if err != nil {
+			// 连接中断时返回1006
+			err = c.setReadErr(err)
+		}
+		if n > 0 || err != nil || len(msg) == 0 {
+			return n, err
+		}
+	}
+}
+
+// NextWriter 返回一个消息写入器, 写入的数据将被分片发送, 调用Close时发送最后一个分片
+// 同一时刻只能有一个消息写入器, 调用NextWriter会关闭上一个未关闭的写入器, 因此NextWriter不能被多个goroutine同时调用
+// 写入器关闭之前, 其他goroutine中的WriteMessage等调用将等待这条消息写完; 同一goroutine在关闭之前调用它们会死锁
+func (c *Conn) NextWriter(messageType byte) (w io.WriteCloser, err error) {
+	if messageType != TextFrame && messageType != BinaryFrame {
+		return nil, ErrBadMessageType
+	}
+	if c.writer != nil {
+		c.writer.Close()
+	}
+	c.writer = c.newWriter(messageType)
+	return c.writer, nil
+}
+
+// WriteMessage 将data作为一条消息发送, 可以被多个goroutine同时调用
+func (c *Conn) WriteMessage(messageType byte, data []byte) error {
+	if messageType != TextFrame && messageType != BinaryFrame {
+		return ErrBadMessageType
+	}
+	if len(c.extensions) > 0 {
+		w := c.newWriter(messageType)
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}
+	c.wmsg.Lock()
+	defer c.wmsg.Unlock()
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	_, err := c.writeFrame(messageType, true, [3]bool{}, data)
+	return err
+}
+
+// newWriter 创建消息写入器, 写入的数据将经过协商成功的扩展变换
+// 写入器持有wmsg直到关闭, 扩展的状态也由wmsg保护
+func (c *Conn) newWriter(messageType byte) io.WriteCloser {
+	c.wmsg.Lock()
+	mw := &messageWriter{
+		conn:        c,
+		payloadType: messageType,
+		buf:         make([]byte, 0, defaultWriteFrameSize),
+	}
+	if len(c.extensions) > 0 {
+		return c.wrapWriter(mw)
+	}
+	return mw
+}
+
+// messageWriter 将数据缓冲后分片写入
+type messageWriter struct {
+	conn *Conn
+	// 第一个分片使用消息类型, 后续分片为ContinuationFrame
+	payloadType byte
+	// 第一个分片的RSV位
+	rsv    [3]bool
+	buf    []byte
+	closed bool
+}
+
+func (w *messageWriter) Write(msg []byte) (n int, err error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	for len(msg) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):cap(w.buf)], msg)
+		w.buf = w.buf[:len(w.buf)+k]
+		msg = msg[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close 发送最后一个分片
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	defer w.conn.wmsg.Unlock()
+	return w.flush(true)
+}
+
+func (w *messageWriter) flush(fin bool) error {
+	c := w.conn
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	_, err := c.writeFrame(w.payloadType, fin, w.rsv, w.buf)
+	w.buf = w.buf[:0]
+	w.payloadType = ContinuationFrame
+	w.rsv = [3]bool{}
+	return err
+}
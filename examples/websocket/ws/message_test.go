@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadFragments(t *testing.T) {
+	testServerRead(t, []readTest{
+		{
+			name:   "text",
+			frames: [][]byte{clientFrame(true, TextFrame, "hello")},
+			want:   []string{"hello"},
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				clientFrame(false, TextFrame, "hel"),
+				clientFrame(false, ContinuationFrame, ""),
+				clientFrame(true, ContinuationFrame, "lo"),
+			},
+			want: []string{"hello"},
+		},
+		{
+			name: "ping between fragments",
+			frames: [][]byte{
+				clientFrame(false, BinaryFrame, "a"),
+				clientFrame(true, PingFrame, "ping"),
+				clientFrame(true, ContinuationFrame, "b"),
+			},
+			want: []string{"ab"},
+		},
+		{
+			name: "truncated payload",
+			frames: [][]byte{
+				clientFrame(true, TextFrame, "one"),
+				clientFrame(true, TextFrame, "hello world")[:12],
+			},
+			want: []string{"one"},
+			err:  &CloseError{Code: closeStatusAbnormalClosure},
+		},
+		{
+			name: "truncated fragment",
+			frames: [][]byte{
+				clientFrame(false, BinaryFrame, "hello "),
+				clientFrame(true, ContinuationFrame, "world")[:8],
+			},
+			err: &CloseError{Code: closeStatusAbnormalClosure},
+		},
+	})
+}
+
+func TestNextWriterFragments(t *testing.T) {
+	_, url := newEchoServer(t, Config{})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 超过写缓冲的消息被分成多个分片发送
+	w, err := c.NextWriter(BinaryFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	for i := 0; i < 10; i++ {
+		chunk := strings.Repeat("fragment ", 1000)
+		want.WriteString(chunk)
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err != ErrWriterClosed {
+		t.Errorf("write after close: %v, want %v", err, ErrWriterClosed)
+	}
+
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if _, err := got.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if messageType != BinaryFrame || !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("echo: type %d, len %d, want len %d", messageType, got.Len(), want.Len())
+	}
+}
@@ -0,0 +1,119 @@
+package ws
+
+// 这个文件实现了预编码消息, 用于向大量连接发送同一条消息
+// 服务端发送的帧不需要掩码, 帧的字节只和是否压缩及压缩级别有关, 可以只编码一次
+
+import (
+	"bytes"
+	"compress/flate"
+	"sync"
+)
+
+// PreparedMessage 是预编码的消息, 可以被多个goroutine同时用于多个连接
+// 帧在第一次发送时按需编码并缓存
+type PreparedMessage struct {
+	messageType byte
+	data        []byte
+
+	mu     sync.Mutex
+	frames map[prepareKey][]byte
+}
+
+// prepareKey 决定帧的编码方式, 不压缩时level为0
+type prepareKey struct {
+	compress bool
+	level    int
+}
+
+// NewPreparedMessage 创建预编码消息, data在之后不能被修改
+func NewPreparedMessage(messageType byte, data []byte) (*PreparedMessage, error) {
+	if messageType != TextFrame && messageType != BinaryFrame {
+		return nil, ErrBadMessageType
+	}
+	return &PreparedMessage{
+		messageType: messageType,
+		data:        data,
+		frames:      make(map[prepareKey][]byte),
+	}, nil
+}
+
+// frame 返回适用于连接c的帧字节, ok为false表示该连接不能使用预编码的帧
+// 客户端每帧使用不同的Masking-Key, 上下文接管的压缩依赖每个连接的字典, 自定义扩展的变换未知, 都无法预编码
+func (pm *PreparedMessage) frame(c *Conn) (frame []byte, ok bool, err error) {
+	if c.IsClientConn() {
+		return nil, false, nil
+	}
+	var key prepareKey
+	switch {
+	case len(c.extensions) == 0:
+	case len(c.extensions) == 1 && c.compression != nil:
+		if c.compression.writeEnabled() {
+			if !c.compression.writeNoContextTakeover {
+				return nil, false, nil
+			}
+			key = prepareKey{compress: true, level: c.compression.level}
+		}
+	default:
+		return nil, false, nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if frame, ok = pm.frames[key]; ok {
+		return frame, true, nil
+	}
+
+	header := &hybiFrameHeader{Fin: true, OpCode: pm.messageType}
+	payload := pm.data
+	if key.compress {
+		header.Rsv[0] = true
+		if payload, err = compressMessage(pm.data, key.level); err != nil {
+			return nil, false, err
+		}
+	}
+	frame = appendFrameHeader(make([]byte, 0, 10+len(payload)), header, int64(len(payload)))
+	frame = append(frame, payload...)
+	pm.frames[key] = frame
+	return frame, true, nil
+}
+
+// compressMessage 不使用上下文压缩一条消息, 并去掉末尾的0x00 0x00 0xff 0xff
+func compressMessage(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	var trunc truncWriter
+	trunc.reset(&buf)
+	// level已经校验过, 不会出错
+	fw, _ := flate.NewWriter(&trunc, level)
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	if !trunc.ok() {
+		return nil, ErrBadExtension
+	}
+	return buf.Bytes(), nil
+}
+
+// WritePreparedMessage 发送预编码消息, 不能预编码的连接将按WriteMessage发送
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	// 压缩设置由wmsg保护
+	c.wmsg.Lock()
+	frame, ok, err := pm.frame(c)
+	if err != nil || !ok {
+		c.wmsg.Unlock()
+		if err != nil {
+			return err
+		}
+		return c.WriteMessage(pm.messageType, pm.data)
+	}
+	defer c.wmsg.Unlock()
+	c.wio.Lock()
+	defer c.wio.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.touch()
+	return c.frameWriterFactory.(*hybiFrameWriterFactory).writeRaw(frame)
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreparedMessage(t *testing.T) {
+	data := []byte(strings.Repeat("prepared ", 1000))
+	tests := []struct {
+		name   string
+		server Config
+		// 客户端是否请求压缩
+		compress bool
+		// 期望缓存的帧, 为nil表示不能预编码
+		want *prepareKey
+	}{
+		{
+			name:     "uncompressed peer",
+			compress: true,
+			want:     &prepareKey{},
+		},
+		{
+			name:     "deflate without context takeover",
+			server:   Config{EnableCompression: true, ServerNoContextTakeover: true},
+			compress: true,
+			want:     &prepareKey{compress: true, level: defaultCompressionLevel},
+		},
+		{
+			name:     "deflate with context takeover",
+			server:   Config{EnableCompression: true},
+			compress: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := NewPreparedMessage(BinaryFrame, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, url := newTestServer(t, &Server{Config: tt.server, Handler: func(c *Conn) {
+				for i := 0; i < 2; i++ {
+					if err := c.WritePreparedMessage(pm); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				c.ReadMessage()
+			}})
+			config, err := NewConfig(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.EnableCompression = tt.compress
+			c, err := DialConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// 第二次发送使用缓存的帧
+			for i := 0; i < 2; i++ {
+				messageType, p, err := c.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if messageType != BinaryFrame || string(p) != string(data) {
+					t.Fatalf("message %d: type %d, len %d", i, messageType, len(p))
+				}
+			}
+
+			pm.mu.Lock()
+			defer pm.mu.Unlock()
+			if tt.want == nil {
+				if len(pm.frames) != 0 {
+					t.Errorf("cached %d frames, want none", len(pm.frames))
+				}
+				return
+			}
+			if _, ok := pm.frames[*tt.want]; !ok || len(pm.frames) != 1 {
+				t.Errorf("cached frames %v, want %+v", pm.frames, *tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPreparedMessageType(t *testing.T) {
+	for _, messageType := range []byte{ContinuationFrame, CloseFrame, PingFrame, PongFrame} {
+		if _, err := NewPreparedMessage(messageType, nil); err != ErrBadMessageType {
+			t.Errorf("type %d: err %v, want %v", messageType, err, ErrBadMessageType)
+		}
+	}
+}
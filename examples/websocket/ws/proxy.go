@@ -0,0 +1,85 @@
+package ws
+
+// 这个文件实现了可信代理和客户端地址的解析
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseTrustedProxies 解析IP或CIDR列表, 无法解析的项将被忽略
+func parseTrustedProxies(proxies []string) (nets []*net.IPNet) {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				continue
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = ip.String() + "/" + strconv.Itoa(bits)
+		}
+		if _, ipnet, err := net.ParseCIDR(proxy); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return
+}
+
+// trustedProxies 返回解析后的TrustedProxies, 只解析一次
+func (s *Server) trustedProxies() []*net.IPNet {
+	s.proxiesOnce.Do(func() {
+		s.proxies = parseTrustedProxies(s.TrustedProxies)
+	})
+	return s.proxies
+}
+
+func isTrustedProxy(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 返回客户端的IP. 直接对端是可信代理时, 从右向左查找X-Forwarded-For中第一个不可信的地址
+func clientIP(peer net.Addr, req *http.Request, nets []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		host = peer.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || len(nets) == 0 || !isTrustedProxy(ip, nets) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !isTrustedProxy(ip, nets) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteAddr 返回客户端地址, 地址来自X-Forwarded-For时端口未知
+func remoteAddr(peer net.Addr, req *http.Request, nets []*net.IPNet) net.Addr {
+	ip := clientIP(peer, req, nets)
+	if ip == nil {
+		return peer
+	}
+	if tcp, ok := peer.(*net.TCPAddr); ok && tcp.IP.Equal(ip) {
+		return peer
+	}
+	return &net.TCPAddr{IP: ip}
+}
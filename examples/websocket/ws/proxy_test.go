@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		xff     []string
+		want    string
+	}{
+		{"no trusted proxies", nil, "10.0.0.1:1234", []string{"1.2.3.4"}, "10.0.0.1"},
+		{"untrusted peer", []string{"10.0.0.2"}, "10.0.0.1:1234", []string{"1.2.3.4"}, "10.0.0.1"},
+		{"trusted peer", []string{"10.0.0.1"}, "10.0.0.1:1234", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"trusted cidr", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"proxy chain", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"1.2.3.4, 10.0.0.5"}, "1.2.3.4"},
+		{"spoofed leftmost entry", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"multiple headers", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{"invalid entry", []string{"10.0.0.0/8"}, "10.0.0.1:1234", []string{"1.2.3.4, garbage"}, "10.0.0.1"},
+		{"ipv6 proxy", []string{"::1"}, "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"invalid trusted entries", []string{"bad", "10.0.0.1/99"}, "10.0.0.1:1234", []string{"1.2.3.4"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{"X-Forwarded-For": tt.xff}}
+			peer, err := net.ResolveTCPAddr("tcp", tt.peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := clientIP(peer, req, parseTrustedProxies(tt.trusted))
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("clientIP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteAddrTrustedProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"untrusted peer ignores header", nil, "127.0.0.1"},
+		{"trusted peer uses header", []string{"127.0.0.1"}, "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newTestServer(t, &Server{
+				TrustedProxies: tt.trusted,
+				Handler: func(c *Conn) {
+					c.WriteMessage(TextFrame, []byte(c.RemoteAddr().String()))
+				},
+			})
+			config, err := NewConfig(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Header = http.Header{"X-Forwarded-For": {"1.2.3.4"}}
+			c, err := DialConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			_, p, err := c.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host, _, _ := net.SplitHostPort(string(p)); host != tt.want {
+				t.Errorf("RemoteAddr = %s, want host %s", p, tt.want)
+			}
+		})
+	}
+}
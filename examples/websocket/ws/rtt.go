@@ -0,0 +1,136 @@
+package ws
+
+// 这个文件实现了通过Ping/Pong测量往返延迟
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// rtt Ping载荷的长度: 8字节nonce + 8字节发送时间(UnixNano)
+const rttPayloadLength = 16
+
+// RTTStats 是连接往返延迟的统计
+type RTTStats struct {
+	// 最近一次测量的延迟
+	Last time.Duration
+	// 最小延迟
+	Min time.Duration
+	// 平滑延迟, 指数加权移动平均(权重1/8, 同TCP的SRTT)
+	Smoothed time.Duration
+	// 测量次数
+	Samples int
+}
+
+// pendingPing 是等待Pong的Ping
+type pendingPing struct {
+	sent time.Time
+	// 为nil时只记录统计
+	result chan time.Duration
+}
+
+// Ping 发送带有nonce和时间戳的Ping并等待对应的Pong, 返回往返延迟
+// Pong只有在应用读取连接时才会被处理, 因此必须有其他goroutine在读取
+// ctx在Ping写出之前结束时, 与WriteMessageContext相同, 中断写入并直接关闭连接
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	result := make(chan time.Duration, 1)
+	stop := watchContext(ctx, func() {
+		if c.setWriteDeadline(time.Now()) != nil {
+			c.closeRWC()
+		}
+	})
+	nonce, err := c.sendPing(result)
+	if stop() {
+		if err != nil {
+			c.closeRWC()
+			return 0, ctx.Err()
+		}
+		// Ping在取消之前已经写完, 恢复调用者的超时设置
+		c.restoreWriteDeadline()
+	}
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case rtt := <-result:
+		return rtt, nil
+	case <-ctx.Done():
+		c.cancelPing(nonce)
+		return 0, ctx.Err()
+	case <-c.done:
+		c.cancelPing(nonce)
+		return 0, net.ErrClosed
+	}
+}
+
+// RTT 返回往返延迟的统计, 心跳发送的Ping同样会被统计
+func (c *Conn) RTT() RTTStats {
+	c.rttMu.Lock()
+	defer c.rttMu.Unlock()
+	return c.rtt
+}
+
+// sendPing 发送测量延迟的Ping, 返回其nonce
+func (c *Conn) sendPing(result chan time.Duration) (nonce uint64, err error) {
+	nonce = c.pingNonce.Add(1)
+	sent := time.Now()
+	payload := make([]byte, rttPayloadLength)
+	binary.BigEndian.PutUint64(payload, nonce)
+	binary.BigEndian.PutUint64(payload[8:], uint64(sent.UnixNano()))
+
+	c.rttMu.Lock()
+	if c.pendingPings == nil {
+		c.pendingPings = make(map[uint64]pendingPing)
+	}
+	c.pendingPings[nonce] = pendingPing{sent: sent, result: result}
+	c.rttMu.Unlock()
+
+	if err = c.WritePing(payload); err != nil {
+		c.cancelPing(nonce)
+		return 0, err
+	}
+	return nonce, nil
+}
+
+func (c *Conn) cancelPing(nonce uint64) {
+	c.rttMu.Lock()
+	delete(c.pendingPings, nonce)
+	c.rttMu.Unlock()
+}
+
+// recordPong 匹配Pong对应的Ping并更新统计, 延迟使用本地记录的发送时间计算
+func (c *Conn) recordPong(data []byte) {
+	if len(data) != rttPayloadLength {
+		return
+	}
+	nonce := binary.BigEndian.Uint64(data)
+
+	c.rttMu.Lock()
+	ping, ok := c.pendingPings[nonce]
+	if !ok {
+		c.rttMu.Unlock()
+		return
+	}
+	delete(c.pendingPings, nonce)
+	rtt := time.Since(ping.sent)
+	c.rtt.Last = rtt
+	if c.rtt.Samples == 0 || rtt < c.rtt.Min {
+		c.rtt.Min = rtt
+	}
+	if c.rtt.Samples == 0 {
+		c.rtt.Smoothed = rtt
+	} else {
+		c.rtt.Smoothed += (rtt - c.rtt.Smoothed) / 8
+	}
+	c.rtt.Samples++
+	c.rttMu.Unlock()
+
+	if ping.result != nil {
+		ping.result <- rtt
+	}
+}
@@ -0,0 +1,70 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	_, url := newEchoServer(t, Config{})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Pong只在读取时处理
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := c.Ping(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Errorf("rtt = %v", rtt)
+		}
+	}
+	if stats := c.RTT(); stats.Samples != 3 || stats.Min > stats.Last {
+		t.Errorf("RTT() = %+v", stats)
+	}
+}
+
+func TestPingBlockedWrite(t *testing.T) {
+	result := make(chan error, 1)
+	_, url := newTestServer(t, &Server{Handler: func(c *Conn) {
+		// 对端不读取, 写入最终阻塞
+		go func() {
+			data := make([]byte, 1<<20)
+			for c.WriteMessage(BinaryFrame, data) == nil {
+			}
+		}()
+		time.Sleep(200 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := c.Ping(ctx)
+		result <- err
+	}})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeRWC()
+
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Ping = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ping not interrupted by ctx")
+	}
+}
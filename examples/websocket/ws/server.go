@@ -4,9 +4,12 @@ package ws
 
 import (
 	"bufio"
-	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Server 代表Websocket服务端
@@ -17,80 +20,283 @@ type Server struct {
 	Handler
 	// 自定义握手行为，比如检查origin，选择子协议
 	Handshake HandShaker
+
+	// 服务端支持的子协议, 按客户端的偏好顺序选择第一个双方都支持的
+	Subprotocols []string
+	// 自定义子协议选择, offered为客户端按偏好排序的子协议, 返回空字符串表示不使用子协议
+	// 设置后将忽略Subprotocols
+	SelectSubprotocol func(req *http.Request, offered []string) string
+	// 客户端提供了子协议但没有双方都支持的子协议时拒绝握手
+	RequireSubprotocol bool
+
+	// 允许的Origin主机, 如"example.com:8080", "*.example.com"匹配所有子域名
+	// 为空时只允许与请求Host相同的Origin, 没有Origin的请求(非浏览器客户端)总是允许
+	AllowedOrigins []string
+	// 允许所有Origin, 这会使服务暴露于跨站WebSocket劫持
+	AllowAllOrigins bool
+
+	// 发送Ping的间隔, 为0时不发送
+	PingInterval time.Duration
+	// 发送Ping后等待Pong的最长时间, 超时后视为连接已断开(1006), 为0时不检查
+	PongWait time.Duration
+	// 没有读写数据消息的最长时间, 超时后以1001关闭连接, 为0时不检查
+	IdleTimeout time.Duration
+
+	// 可信代理的IP或CIDR. 对端是可信代理时, Conn.RemoteAddr将从X-Forwarded-For中获取客户端地址
+	// 在处理第一个请求时解析, 之后的修改不会生效
+	TrustedProxies []string
+
+	// 握手时的认证, 为nil时不认证. 在检查Origin之后, Handshake之前进行
+	Authenticator Authenticator
+	// 存放凭证的Cookie名和查询参数名, 为空时不从该处提取
+	AuthCookie string
+	AuthQuery  string
+	// 凭证子协议的前缀. 如前缀为"access_token.", 子协议"access_token.xxx"中的xxx即为凭证, 该子协议不参与选择
+	// 没有选中其他子协议时, 响应将回显凭证子协议, 否则浏览器会认为握手失败, 连接的Subprotocol仍为空
+	AuthProtocolPrefix string
+	// 401响应中WWW-Authenticate的realm
+	AuthRealm string
+
+	// 最大连接数, 超出时以503拒绝握手, 为0时不限制
+	MaxConns int
+	// 每个客户端IP的最大连接数, 超出时以429拒绝握手, 为0时不限制. 客户端IP按TrustedProxies解析
+	MaxConnsPerIP int
+	// 每个客户端IP每秒允许的握手请求数, 超出时以429拒绝握手, 为0时不限制
+	UpgradeRate float64
+	// 每个客户端IP允许的突发握手请求数, 小于1时为1
+	UpgradeBurst int
+
+	// 自定义握手失败时的HTTP响应, 为nil时使用http.Error
+	Error func(w http.ResponseWriter, req *http.Request, status int, reason error)
+	// 每次拒绝握手时调用, 用于日志和统计. 劫持之后的失败status为500
+	OnReject func(req *http.Request, status int, reason error)
+
+	// 用于保护conns和inShutdown
+	mu         sync.Mutex
+	conns      map[*Conn]struct{}
+	inShutdown bool
+	// 正在处理的升级请求, 包括握手和处理器
+	serving sync.WaitGroup
+
+	// 用于保护limits
+	limitMu sync.Mutex
+	limits  limitState
+
+	// 解析后的TrustedProxies
+	proxiesOnce sync.Once
+	proxies     []*net.IPNet
+}
+
+// ServeHTTP 实现了http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.serveWebSocket(w, req)
 }
 
 // 伺服Websocket
-func (s Server) serveWebSocket(w http.ResponseWriter, req *http.Request) {
-	// 是否实现了http.Hijacker
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		panic("websocket serve failed: doesn't support Hijack")
+func (s *Server) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	// 正在关闭的服务不再接受新连接
+	if !s.startServe() {
+		s.reject(w, req, http.StatusServiceUnavailable, ErrServerClosed)
+		return
 	}
+	// 最先登记, 最后执行: Shutdown等待所有名额和连接都已释放
+	defer s.serving.Done()
+
+	// 在劫持之前完成所有检查, 拒绝时通过ResponseWriter响应
+	ip := s.limitKey(req)
+	if retryAfter, ok := s.allowUpgrade(ip); !ok {
+		s.rejectRetry(w, req, http.StatusTooManyRequests, retryAfter, ErrRateLimited)
+		return
+	}
+
+	hs, code, err := s.readHandshake(req)
+	if err != nil {
+		s.reject(w, req, code, err)
+		return
+	}
+
+	release, code, err := s.acquireConn(ip)
+	if err != nil {
+		s.rejectRetry(w, req, code, connLimitRetryAfter, err)
+		return
+	}
+	defer release()
+
 	// 对http连接进行劫持， 以接管接下来的TCP请求
-	conn, rw, err := hj.Hijack()
+	// ResponseController可以穿过中间件包装的ResponseWriter
+	conn, rw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
-		panic("websocket hijack failed")
+		s.reject(w, req, http.StatusInternalServerError, err)
+		return
 	}
 
-	// 如果客户端的握手不符合协议，将关闭连接
+	// 如果握手失败，将关闭连接
 	defer conn.Close()
 	// 新建Websocket服务连接, 主要进行握手，初始化配置和连接
-	wsConn, err := newServerConn(conn, rw, req, &s.Config, s.Handshake)
+	wsConn, err := newServerConn(hs, conn, rw, req, s)
 	if err != nil {
+		s.rejected(req, http.StatusInternalServerError, err)
 		return
 	}
 
-	if wsConn == nil {
-		panic("unexpected nil conn")
+	defer wsConn.closeRWC()
+	if !s.trackConn(wsConn) {
+		wsConn.CloseWithReason(closeStatusGoingAway, "server shutdown")
+		return
+	}
+	defer s.untrackConn(wsConn)
+	if s.PingInterval > 0 || s.IdleTimeout > 0 {
+		go wsConn.heartbeat(s.PingInterval, s.PongWait, s.IdleTimeout)
 	}
 	// 开始处理连接
 	s.Handler(wsConn)
 }
 
-func newServerConn(conn net.Conn, buf *bufio.ReadWriter, req *http.Request, config *Config, handshake HandShaker) (wsConn *Conn, err error) {
-	hs := hybiServerHandshaker{Config: config}
-	code, err := hs.ReadHandshake(buf.Reader, req)
-	if err == ErrBadRequestMethod {
-		fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
-		fmt.Fprintf(buf, "Sec-Websocket-Version: %s\r\n", SupportedProtocolVersion)
-		buf.WriteString("\r\n")
-		buf.WriteString(err.Error())
-		buf.Flush()
-		return
+// readHandshake 读取并检查客户端握手, 失败时返回响应状态码
+func (s *Server) readHandshake(req *http.Request) (hs *hybiServerHandshaker, code int, err error) {
+	// 每个连接使用独立的配置, 握手时将填入Location, Protocol等
+	config := new(Config)
+	*config = s.Config
+	hs = &hybiServerHandshaker{Config: config}
+	code, err = hs.ReadHandshake(req)
+	if err != nil {
+		return nil, code, err
 	}
 
-	if err != nil {
-		fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
-		buf.WriteString("\r\n")
-		buf.WriteString(err.Error())
-		buf.Flush()
-		return
+	// 检查Origin, 防止跨站WebSocket劫持
+	if !s.checkOrigin(config.Origin, req) {
+		return nil, http.StatusForbidden, ErrBadOrigin
 	}
 
-	// 自定义握手
-	if handshake != nil {
-		err = handshake(config, req)
+	// 认证
+	var creds *Credentials
+	if s.Authenticator != nil {
+		creds = s.extractCredentials(config, req)
+		hs.principal, code, err = s.authenticate(req, creds)
 		if err != nil {
-			code = http.StatusForbidden
-			fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
-			buf.WriteString("\r\n")
-			buf.Flush()
-			return
+			return nil, code, err
 		}
 	}
 
-	err = hs.AcceptHandshake(buf.Writer)
-	if err != nil {
-		code = http.StatusBadRequest
-		fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
-		buf.WriteString("\r\n")
-		buf.Flush()
-		return
+	// 自定义握手
+	if s.Handshake != nil {
+		if err = s.Handshake(config, req); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+	}
+
+	// 选择子协议
+	if err = s.selectSubprotocol(config, req); err != nil {
+		return nil, http.StatusBadRequest, err
 	}
+	// 客户端提供了子协议, 响应中必须选择其中一个, 但凭证不是协商的子协议
+	if len(config.Protocol) == 0 && creds != nil && creds.Source == CredentialProtocol {
+		hs.echoProtocol = creds.protocol
+	}
+	return hs, http.StatusSwitchingProtocols, nil
+}
 
-	// 新建一个Websocket连接
+// newServerConn 在劫持的连接上发送握手响应, 并新建一个Websocket连接
+func newServerConn(hs *hybiServerHandshaker, conn net.Conn, buf *bufio.ReadWriter, req *http.Request, s *Server) (wsConn *Conn, err error) {
+	if err = hs.AcceptHandshake(buf.Writer); err != nil {
+		return nil, err
+	}
 	wsConn = hs.NewServerConn(buf, conn, req)
-	return
+	wsConn.remoteAddr = remoteAddr(conn.RemoteAddr(), req, s.trustedProxies())
+	return wsConn, nil
+}
+
+// reject 在劫持之前拒绝握手
+func (s *Server) reject(w http.ResponseWriter, req *http.Request, status int, reason error) {
+	s.rejected(req, status, reason)
+	if reason == ErrBadRequestMethod || reason == ErrBadWebSocketVersion {
+		// 告知客户端支持的版本
+		w.Header().Set("Sec-WebSocket-Version", SupportedProtocolVersion)
+	}
+	if status == http.StatusUnauthorized && s.Authenticator != nil {
+		w.Header().Set("WWW-Authenticate", s.authChallenge(reason))
+	}
+	if s.Error != nil {
+		s.Error(w, req, status, reason)
+		return
+	}
+	http.Error(w, reason.Error(), status)
+}
+
+// rejected 报告被拒绝的握手
+func (s *Server) rejected(req *http.Request, status int, reason error) {
+	if s.OnReject != nil {
+		s.OnReject(req, status, reason)
+	}
+}
+
+// checkOrigin 检查Origin是否被允许
+func (s *Server) checkOrigin(origin *url.URL, req *http.Request) bool {
+	if origin == nil || s.AllowAllOrigins {
+		return true
+	}
+	if len(s.AllowedOrigins) == 0 {
+		return strings.EqualFold(origin.Host, req.Host)
+	}
+	for _, pattern := range s.AllowedOrigins {
+		if matchOrigin(pattern, origin.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin 不区分大小写地匹配主机, "*."前缀匹配任意子域名(不包括域名本身)
+func matchOrigin(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return pattern == host
+}
+
+// selectSubprotocol 从客户端提供的子协议中选择一个, 结果保存在config.Protocol中
+// 没有配置Subprotocols和SelectSubprotocol时, 只有客户端提供唯一的子协议(或由Handshake选定)才会使用
+func (s *Server) selectSubprotocol(config *Config, req *http.Request) error {
+	offered := config.Protocol
+	if len(offered) == 0 {
+		return nil
+	}
+
+	var selected string
+	switch {
+	case s.SelectSubprotocol != nil:
+		selected = s.SelectSubprotocol(req, offered)
+	case s.Subprotocols != nil:
+		for _, protocol := range offered {
+			if containsString(s.Subprotocols, protocol) {
+				selected = protocol
+				break
+			}
+		}
+	case len(offered) == 1:
+		selected = offered[0]
+	}
+
+	if selected == "" {
+		if s.RequireSubprotocol {
+			return ErrBadWebSocketProtocol
+		}
+		config.Protocol = nil
+		return nil
+	}
+	config.Protocol = []string{selected}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, val := range list {
+		if val == s {
+			return true
+		}
+	}
+	return false
 }
 
 // HandShaker 用于自定义握手行为
@@ -0,0 +1,236 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestServer 启动服务端, 返回其ws地址
+func newTestServer(t *testing.T, s *Server) (*httptest.Server, string) {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// newEchoServer 启动一个原样返回消息的服务端
+func newEchoServer(t *testing.T, config Config) (*httptest.Server, string) {
+	return newTestServer(t, &Server{Config: config, Handler: func(c *Conn) {
+		for {
+			messageType, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = c.WriteMessage(messageType, p); err != nil {
+				return
+			}
+		}
+	}})
+}
+
+func TestSubprotocolSelection(t *testing.T) {
+	last := func(req *http.Request, offered []string) string { return offered[len(offered)-1] }
+	tests := []struct {
+		name    string
+		server  *Server
+		offered []string
+		want    string
+		// 期望握手失败的状态码
+		status int
+	}{
+		{
+			name:    "client preference order",
+			server:  &Server{Subprotocols: []string{"b", "a"}},
+			offered: []string{"a", "b"},
+			want:    "a",
+		},
+		{
+			name:    "no common protocol",
+			server:  &Server{Subprotocols: []string{"c"}},
+			offered: []string{"a", "b"},
+		},
+		{
+			name:    "no common protocol required",
+			server:  &Server{Subprotocols: []string{"c"}, RequireSubprotocol: true},
+			offered: []string{"a"},
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "nothing offered",
+			server:  &Server{Subprotocols: []string{"c"}, RequireSubprotocol: true},
+			offered: nil,
+		},
+		{
+			name:    "single offer without configuration",
+			offered: []string{"a"},
+			want:    "a",
+		},
+		{
+			name:    "several offers without configuration",
+			offered: []string{"a", "b"},
+		},
+		{
+			name:    "selection hook overrides list",
+			server:  &Server{Subprotocols: []string{"a"}, SelectSubprotocol: last},
+			offered: []string{"a", "b"},
+			want:    "b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			if s == nil {
+				s = &Server{}
+			}
+			s.Handler = func(c *Conn) {
+				c.WriteMessage(TextFrame, []byte(c.Subprotocol()))
+			}
+			_, url := newTestServer(t, s)
+			config, err := NewConfig(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Protocol = tt.offered
+			c, err := DialConfig(config)
+			if tt.status != 0 {
+				var statusErr *StatusError
+				if !errors.As(err, &statusErr) || statusErr.StatusCode != tt.status {
+					t.Fatalf("err = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got := c.Subprotocol(); got != tt.want {
+				t.Errorf("client Subprotocol = %q, want %q", got, tt.want)
+			}
+			if _, p, err := c.ReadMessage(); err != nil || string(p) != tt.want {
+				t.Errorf("server Subprotocol = %q, %v, want %q", p, err, tt.want)
+			}
+		})
+	}
+}
+
+// upgrade 发送原始的握手请求, 返回响应. 101响应的Body是升级后的连接
+func upgrade(t *testing.T, srv *httptest.Server, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestOriginCheck(t *testing.T) {
+	wildcard := []string{"*.example.com"}
+	tests := []struct {
+		name    string
+		allowed []string
+		all     bool
+		// 为空时不发送Origin, "same"表示与请求Host相同
+		origin string
+		want   int
+	}{
+		{"exact match", []string{"example.com"}, false, "https://example.com", http.StatusSwitchingProtocols},
+		{"exact match ignores case", []string{"example.com"}, false, "https://EXAMPLE.com", http.StatusSwitchingProtocols},
+		{"port mismatch", []string{"example.com:8080"}, false, "https://example.com", http.StatusForbidden},
+		{"wildcard subdomain", wildcard, false, "https://a.example.com", http.StatusSwitchingProtocols},
+		{"wildcard nested subdomain", wildcard, false, "https://a.b.example.com", http.StatusSwitchingProtocols},
+		{"wildcard excludes apex", wildcard, false, "https://example.com", http.StatusForbidden},
+		{"wildcard suffix attack", wildcard, false, "https://evil-example.com", http.StatusForbidden},
+		{"not in list", wildcard, false, "https://evil.com", http.StatusForbidden},
+		{"no origin header", wildcard, false, "", http.StatusSwitchingProtocols},
+		{"malformed origin", wildcard, false, "a.example.com", http.StatusForbidden},
+		{"same origin by default", nil, false, "same", http.StatusSwitchingProtocols},
+		{"cross origin by default", nil, false, "https://evil.com", http.StatusForbidden},
+		{"allow all origins", nil, true, "https://evil.com", http.StatusSwitchingProtocols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newTestServer(t, &Server{
+				AllowedOrigins:  tt.allowed,
+				AllowAllOrigins: tt.all,
+				Handler:         func(c *Conn) {},
+			})
+			header := make(http.Header)
+			switch tt.origin {
+			case "":
+			case "same":
+				header.Set("Origin", srv.URL)
+			default:
+				header.Set("Origin", tt.origin)
+			}
+			if resp := upgrade(t, srv, header); resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectHooks(t *testing.T) {
+	type rejection struct {
+		status int
+		reason error
+	}
+	var rejected []rejection
+	s := &Server{
+		AllowedOrigins: []string{"example.com"},
+		Handler:        func(c *Conn) {},
+		OnReject: func(req *http.Request, status int, reason error) {
+			rejected = append(rejected, rejection{status, reason})
+		},
+	}
+	srv, _ := newTestServer(t, s)
+
+	// 自定义响应
+	s.Error = func(w http.ResponseWriter, req *http.Request, status int, reason error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, `{"error":"`+reason.Error()+`"}`)
+	}
+	resp := upgrade(t, srv, http.Header{"Origin": {"https://evil.com"}})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Content-Type") != "application/json" || string(body) != `{"error":"bad origin"}` {
+		t.Errorf("custom error: status %d, %q, %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	// 默认使用http.Error
+	s.Error = nil
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	resp = upgrade(t, srv, nil)
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "server closed\n" {
+		t.Errorf("default error: status %d, %q", resp.StatusCode, body)
+	}
+
+	want := []rejection{
+		{http.StatusForbidden, ErrBadOrigin},
+		{http.StatusServiceUnavailable, ErrServerClosed},
+	}
+	if !reflect.DeepEqual(rejected, want) {
+		t.Errorf("OnReject calls = %v, want %v", rejected, want)
+	}
+}
@@ -0,0 +1,86 @@
+package ws
+
+// 这个文件实现了服务端的连接登记和优雅关闭
+
+import (
+	"context"
+)
+
+// ErrServerClosed 表示服务端正在关闭, 不再接受新连接
+var ErrServerClosed = &ProtocolError{"server closed"}
+
+// Shutdown 停止接受新连接, 向所有连接发送1001关闭帧, 并等待关闭握手完成和处理器返回
+// ctx结束时强制关闭剩余的连接并返回ctx.Err(), 此时处理器可能仍在运行
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		go conn.CloseWithReason(closeStatusGoingAway, "server shutdown")
+	}
+
+	served := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		// 包括关闭开始之后才完成握手的连接
+		s.mu.Lock()
+		for conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.mu.Unlock()
+		for _, conn := range conns {
+			conn.closeRWC()
+		}
+		return ctx.Err()
+	}
+}
+
+// ConnCount 返回当前的连接数
+func (s *Server) ConnCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// startServe 登记一个升级请求, 服务端正在关闭时返回false
+func (s *Server) startServe() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	s.serving.Add(1)
+	return true
+}
+
+// trackConn 登记连接, 服务端正在关闭时返回false
+func (s *Server) trackConn(conn *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn *Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
@@ -0,0 +1,85 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	var handlerDone atomic.Bool
+	started := make(chan struct{})
+	s := &Server{Handler: func(c *Conn) {
+		close(started)
+		c.ReadMessage()
+		// 处理器在连接关闭后还有收尾工作
+		time.Sleep(100 * time.Millisecond)
+		handlerDone.Store(true)
+	}}
+	srv, url := newTestServer(t, s)
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-started
+	if n := s.ConnCount(); n != 1 {
+		t.Errorf("ConnCount = %d, want 1", n)
+	}
+
+	// 客户端收到1001关闭帧
+	received := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		received <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !handlerDone.Load() {
+		t.Error("Shutdown returned before the handler")
+	}
+	want := &CloseError{Code: CloseGoingAway, Text: "server shutdown"}
+	if err := <-received; !reflect.DeepEqual(err, want) {
+		t.Errorf("client read: %v, want %v", err, want)
+	}
+
+	// 关闭后拒绝新的握手
+	if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("upgrade after Shutdown: status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestShutdownContextExpired(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s := &Server{Handler: func(c *Conn) {
+		close(started)
+		// 处理器不理会关闭
+		<-release
+	}}
+	_, url := newTestServer(t, s)
+	defer close(release)
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.closeRWC()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 剩余的连接被强制关闭
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Fatal("connection still open")
+	}
+}
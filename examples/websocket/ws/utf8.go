@@ -0,0 +1,70 @@
+package ws
+
+// 这个文件实现了增量式的utf-8校验, 用于跨越分片的文本消息
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// utf8Validator 保存上一次写入末尾不完整的字符
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// complete 表示没有未完成的字符
+func (v *utf8Validator) complete() bool {
+	return v.n == 0
+}
+
+// write 校验p, 末尾不完整的字符将与下一次写入拼接后校验
+func (v *utf8Validator) write(p []byte) bool {
+	// 先补全上次不完整的字符
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			r, size := utf8.DecodeRune(v.pending[:v.n])
+			if r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+
+	if utf8.Valid(p) {
+		return true
+	}
+
+	// 查找末尾字符的起始字节
+	start := len(p) - 1
+	for start > 0 && start > len(p)-utf8.UTFMax && !utf8.RuneStart(p[start]) {
+		start--
+	}
+	if utf8.FullRune(p[start:]) || !utf8.Valid(p[:start]) {
+		return false
+	}
+	v.n = copy(v.pending[:], p[start:])
+	return true
+}
+
+// utf8Reader 在读取文本消息时校验utf-8编码, 校验失败时以1007关闭连接
+type utf8Reader struct {
+	conn *Conn
+	r    io.Reader
+	v    utf8Validator
+}
+
+func (r *utf8Reader) Read(msg []byte) (n int, err error) {
+	n, err = r.r.Read(msg)
+	if !r.v.write(msg[:n]) {
+		return 0, r.conn.failRead(closeStatusBadMessageData, ErrInvalidUTF8)
+	}
+	// 消息结束时不能有不完整的字符
+	if err == io.EOF && !r.v.complete() {
+		return 0, r.conn.failRead(closeStatusBadMessageData, ErrInvalidUTF8)
+	}
+	return n, err
+}
@@ -1,14 +1,19 @@
-// Package ws 实现websocket协议服务端
+// Package ws 实现websocket协议服务端和客户端
 // 协议原文: https://tools.ietf.org/html/rfc6455
 // 协议(中文解析)： http://blog.csdn.net/stoneson/article/details/8073285
 package ws
 
 import (
-	"bufio"
+	"crypto/tls"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -36,6 +41,22 @@ const (
 
 	// 默认最大载荷 32MB
 	DefaultMaxPayloadBytes = 32 << 20
+
+	// 关闭状态码, 用于CloseWithReason和CloseError
+	CloseNormalClosure    = closeStatusNormal
+	CloseGoingAway        = closeStatusGoingAway
+	CloseProtocolError    = closeStatusProtocolError
+	CloseUnsupportedData  = closeStatusUnsupportedData
+	CloseNoStatusReceived = closeStatusNoStatusRcvd
+	CloseAbnormalClosure  = closeStatusAbnormalClosure
+	CloseInvalidPayload   = closeStatusBadMessageData
+	ClosePolicyViolation  = closeStatusPolicyViolation
+	CloseMessageTooBig    = closeStatusTooBigData
+	CloseMandatoryExt     = closeStatusExtensionMismatch
+	CloseInternalError    = closeStatusInternalError
+
+	// 发送关闭帧后等待对端关闭帧的最长时间
+	closeHandshakeTimeout = 5 * time.Second
 )
 
 var (
@@ -45,10 +66,38 @@ var (
 	ErrNotWebSocket        = &ProtocolError{"not websocket"}
 	ErrMissKey             = &ProtocolError{"missing key"}
 	ErrBadWebSocketVersion = &ProtocolError{"bad websocket verison"}
+	// ErrBadOrigin 表示Origin不被允许
+	ErrBadOrigin = &ProtocolError{"bad origin"}
 	// ErrBadWebSocketProtocol 表示服务端必须从子协议中选一个协议
 	ErrBadWebSocketProtocol = &ProtocolError{"bad websocket Protocol"}
 	// ErrBadMaskingKey 表示生成的masking key有误
 	ErrBadMaskingKey = &ProtocolError{"bad masking-key"}
+	// 客户端握手错误
+	ErrBadLocation       = &ProtocolError{"bad location"}
+	ErrBadScheme         = &ProtocolError{"bad scheme"}
+	ErrBadStatus         = &ProtocolError{"bad status"}
+	ErrBadUpgrade        = &ProtocolError{"missing or bad upgrade"}
+	ErrChallengeResponse = &ProtocolError{"mismatch challenge/response"}
+	// ErrCloseSent 表示已经发送了关闭帧, 不能再写入数据
+	ErrCloseSent = &ProtocolError{"close sent"}
+	// ErrBadCloseStatus 表示关闭状态码或原因不能被发送
+	ErrBadCloseStatus = &ProtocolError{"bad close status"}
+	// ErrBadFrameLength 表示64位载荷长度的最高位被设置
+	ErrBadFrameLength = &ProtocolError{"bad frame length"}
+	// ErrFrameTooLarge 表示帧载荷超过了MaxFramePayloadBytes
+	ErrFrameTooLarge = &ProtocolError{"frame payload too large"}
+	// ErrMessageTooLarge 表示消息载荷(所有分片之和)超过了MaxPayloadBytes
+	ErrMessageTooLarge = &ProtocolError{"message payload too large"}
+	// 严格模式下的协议错误
+	ErrMaskRequired           = &ProtocolError{"client frame is not masked"}
+	ErrUnexpectedMask         = &ProtocolError{"server frame is masked"}
+	ErrReservedBits           = &ProtocolError{"reserved bits are set"}
+	ErrReservedOpCode         = &ProtocolError{"reserved opcode"}
+	ErrFragmentedControlFrame = &ProtocolError{"fragmented control frame"}
+	ErrControlFrameTooLarge   = &ProtocolError{"control frame payload exceeds 125 bytes"}
+	ErrUnexpectedContinuation = &ProtocolError{"continuation frame without message in progress"}
+	ErrExpectedContinuation   = &ProtocolError{"new data frame while message in progress"}
+	ErrInvalidUTF8            = &ProtocolError{"invalid utf-8 in text message"}
 )
 
 // ProtocolError 代表协议错误
@@ -60,16 +109,65 @@ func (pe *ProtocolError) Error() string {
 	return pe.ErrorString
 }
 
+// CloseError 表示收到了对端的关闭帧, 或者连接被异常关闭
+type CloseError struct {
+	// 关闭状态码
+	Code int
+	// 关闭原因, utf-8编码
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return "close " + strconv.Itoa(e.Code)
+	}
+	return "close " + strconv.Itoa(e.Code) + ": " + e.Text
+}
+
 // Config websocket 配置
 type Config struct {
 	// websocket协议版本
 	Version int
 	// websocket 服务地址
 	Location *url.URL
+	// 客户端的Origin. 服务端从握手请求中解析, 客户端设置后将在握手时发送
+	Origin *url.URL
 	// 子协议
 	Protocol []string
 	// 额外的http报头，将在握手时一同发送
 	Header http.Header
+
+	// 单条消息(所有分片之和)的最大载荷, 为0时使用DefaultMaxPayloadBytes, 为负数时不限制
+	MaxPayloadBytes int64
+	// 单个帧的最大载荷, 为0时与MaxPayloadBytes相同, 为负数时不限制
+	MaxFramePayloadBytes int64
+
+	// 关闭严格协议校验(RSV, 操作码, 控制帧, 分片顺序和utf-8), 默认开启
+	DisableStrictMode bool
+
+	// 启用permessage-deflate压缩扩展
+	EnableCompression bool
+	// 压缩级别, 参见compress/flate, 为0时使用flate.BestSpeed
+	CompressionLevel int
+	// 服务端压缩时每条消息都重置上下文
+	ServerNoContextTakeover bool
+	// 要求客户端压缩时每条消息都重置上下文
+	ClientNoContextTakeover bool
+	// 自定义扩展, 按顺序参与Sec-WebSocket-Extensions协商
+	Extensions []Extension
+
+	// 读写缓冲大小, 为0时读取沿用握手使用的缓冲, 写缓冲为4KB
+	ReadBufferSize  int
+	WriteBufferSize int
+	// 不为nil时, 读缓冲只在读取帧时持有, 等待下一帧时归还到池中
+	ReadBufferPool BufferPool
+	// 写缓冲只在写入帧时从池中借用, 为nil时使用包级别的sync.Pool
+	WriteBufferPool BufferPool
+
+	// 客户端wss连接的TLS配置
+	TlsConfig *tls.Config
+	// 客户端拨号器, 为nil时使用默认值
+	Dialer *net.Dialer
 }
 
 // Conn 是websocket 连接实现
@@ -77,28 +175,86 @@ type Conn struct {
 	config  *Config
 	request *http.Request
 
-	buf *bufio.ReadWriter
 	rwc io.ReadWriteCloser
+	// 对端地址, 为nil时从rwc获取
+	remoteAddr net.Addr
+	// 握手信息
+	handshake HandshakeInfo
+	// 服务端认证得到的principal
+	principal interface{}
 
 	// 用于保护frameReader
 	rio sync.Mutex
 	// 帧读取器
 	frameReaderFactory
 	frameReader
+	// 最近读取的帧是否是消息的最后一个分片
+	readFin bool
+	// 每次调用NextReader时递增, 使之前的消息读取器失效
+	readSeq uint64
+	// 最近一次NextReader返回的读取器
+	reader io.Reader
 
 	// 用于保护frameWriter
 	wio sync.Mutex
 	// 帧写入器
 	frameWriterFactory
 	frameWriter
+	// 保证一条数据消息的所有分片连续写出, 从创建消息写入器持有到关闭
+	// 控制帧只使用wio, 可以插在分片之间
+	wmsg sync.Mutex
+	// 最近一次NextWriter返回的写入器
+	writer io.WriteCloser
+
+	// 协商成功的扩展及其占用的RSV位
+	extensions   []ExtensionConn
+	extensionRsv [3]bool
+	// permessage-deflate压缩状态, 未协商时为nil
+	compression *compression
 
-	// 载荷类型
+	// Write发送的消息类型, 默认为BinaryFrame, 使Conn可以作为net.Conn传输任意字节
+	// 设为TextFrame时写入的数据必须是utf-8编码, 否则对端将以1007关闭
 	PayloadType byte
 	// 默认关闭状态
 	defaultCloseStatus int
-	MaxPayloadBytes    int
+	// 单条消息的最大载荷, 超出时以1009关闭连接, 为负数时不限制
+	MaxPayloadBytes int64
+	// 单个帧的最大载荷
+	maxFramePayloadBytes int64
 
 	frameHandler
+
+	// 读取错误, 出错后的所有读取都将返回该错误
+	readErr error
+	// 是否已经发送关闭帧, 由wio保护
+	closeSent bool
+	// 收到对端关闭帧时关闭
+	closeRcvd     chan struct{}
+	closeRcvdOnce sync.Once
+	// 读取出错(包括收到关闭帧)后关闭
+	readDone     chan struct{}
+	readDoneOnce sync.Once
+	// 底层连接关闭时关闭
+	done     chan struct{}
+	doneOnce sync.Once
+	// 连接被主动中断的原因, 之后的读取错误都将替换为该错误
+	abortErr atomic.Value
+	// 调用者设置的读写超时(UnixNano, 0表示不超时), 内部临时修改超时后据此恢复
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+
+	// Ping/Pong处理函数
+	pingHandler func(appData []byte) error
+	pongHandler func(appData []byte) error
+	// 最近收到Pong和读写数据消息的时间(UnixNano)
+	lastPong     atomic.Int64
+	lastActivity atomic.Int64
+
+	// 用于保护pendingPings和rtt
+	rttMu        sync.Mutex
+	pendingPings map[uint64]pendingPing
+	pingNonce    atomic.Uint64
+	rtt          RTTStats
 }
 
 // 服务端
@@ -107,32 +263,144 @@ func (c *Conn) IsServerConn() bool { return c.request != nil }
 // 客户端
 func (c *Conn) IsClientConn() bool { return c.request == nil }
 
+// Request 返回服务端握手时的http请求, 客户端连接返回nil
+func (c *Conn) Request() *http.Request { return c.request }
+
+// Config 返回连接的配置
+func (c *Conn) Config() *Config { return c.config }
+
+// LocalAddr 返回本端地址. 底层连接不是net.Conn时, 服务端返回Location, 客户端返回Origin
+func (c *Conn) LocalAddr() net.Addr {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	if c.IsServerConn() {
+		return &Addr{c.config.Location}
+	}
+	return &Addr{c.config.Origin}
+}
+
+// RemoteAddr 返回对端地址. 服务端配置了可信代理时, 返回X-Forwarded-For中的客户端地址
+// 底层连接不是net.Conn时, 服务端返回Origin, 客户端返回Location
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	if c.IsServerConn() {
+		return &Addr{c.config.Origin}
+	}
+	return &Addr{c.config.Location}
+}
+
+// Addr 是websocket地址, 实现了net.Addr
+type Addr struct {
+	*url.URL
+}
+
+// Network 返回网络名称"websocket"
+func (addr *Addr) Network() string { return "websocket" }
+
+// String 返回地址的字符串表示, URL为nil时返回空字符串
+func (addr *Addr) String() string {
+	if addr.URL == nil {
+		return ""
+	}
+	return addr.URL.String()
+}
+
+// Subprotocol 返回握手时协商的子协议, 没有协商子协议时返回空字符串
+func (c *Conn) Subprotocol() string {
+	if len(c.config.Protocol) == 1 {
+		return c.config.Protocol[0]
+	}
+	return ""
+}
+
 func (c *Conn) Read(msg []byte) (n int, err error) {
-	c.rio.Lock()
-	defer c.rio.Unlock()
 again:
-	if c.frameReader == nil {
-		// 新建reader
+	if c.reader == nil {
+		if _, c.reader, err = c.NextReader(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = c.reader.Read(msg)
+	if err == io.EOF {
+		// 当前消息已读完, 继续读取下一条消息
+		c.reader = nil
+		err = nil
+		if n == 0 {
+			goto again
+		}
+	}
+	return n, err
+}
+
+// nextFrame 读取下一个数据帧, 控制帧由frameHandler处理. 调用者必须持有rio
+func (c *Conn) nextFrame() error {
+	for {
 		frame, err := c.frameReaderFactory.NewFrameReader()
 		if err != nil {
-			return 0, err
+			if err == ErrBadFrameLength {
+				c.frameHandler.WriteClose(closeStatusProtocolError, "")
+			}
+			return c.setReadErr(err)
 		}
-		c.frameReader, err = c.frameHandler.HandleFrame(frame)
+		r, err := c.frameHandler.HandleFrame(frame)
 		if err != nil {
-			return 0, err
+			return c.setReadErr(err)
 		}
-		if c.frameReader == nil {
-			goto again
+		if r != nil {
+			c.frameReader = r
+			c.readFin = r.fin()
+			return nil
 		}
 	}
-	n, err = c.frameReader.Read(msg)
-	return n, err
 }
 
+// failRead 发送关闭帧并记录读取错误
+func (c *Conn) failRead(status int, err error) error {
+	c.frameHandler.WriteClose(status, "")
+	c.rio.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+		c.readDoneOnce.Do(func() { close(c.readDone) })
+	}
+	c.rio.Unlock()
+	return err
+}
+
+// 记录读取错误, 帧报头处的EOF表示连接被异常关闭
+func (c *Conn) setReadErr(err error) error {
+	if abortErr, ok := c.abortErr.Load().(error); ok {
+		err = abortErr
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = &CloseError{Code: closeStatusAbnormalClosure}
+	}
+	c.readErr = err
+	c.readDoneOnce.Do(func() { close(c.readDone) })
+	return err
+}
+
+// Write 将msg作为一条PayloadType类型的消息发送
 func (c *Conn) Write(msg []byte) (n int, err error) {
-	c.wio.Lock()
-	defer c.wio.Unlock()
-	w, err := c.frameWriterFactory.NewFrameWriter(c.PayloadType)
+	if err = c.WriteMessage(c.PayloadType, msg); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// writeFrame 将msg作为一个帧写入. 调用者必须持有wio
+func (c *Conn) writeFrame(payloadType byte, fin bool, rsv [3]bool, msg []byte) (n int, err error) {
+	if c.closeSent {
+		return 0, ErrCloseSent
+	}
+	if payloadType < CloseFrame {
+		c.touch()
+	}
+	w, err := c.frameWriterFactory.newFragmentWriter(payloadType, fin, rsv)
 	if err != nil {
 		return 0, err
 	}
@@ -141,6 +409,86 @@ func (c *Conn) Write(msg []byte) (n int, err error) {
 	return n, err
 }
 
+// Close 使用默认状态码关闭连接
+func (c *Conn) Close() error {
+	return c.CloseWithReason(c.defaultCloseStatus, "")
+}
+
+// CloseWithReason 发送关闭帧, 等待对端回复关闭帧(最长closeHandshakeTimeout)后关闭底层连接
+// reason 必须是utf-8编码, 且不能超过123字节
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	if err := c.frameHandler.WriteClose(code, reason); err != nil {
+		if err == ErrBadCloseStatus {
+			return err
+		}
+		if err != ErrCloseSent {
+			c.closeRWC()
+			return err
+		}
+	}
+	c.waitClose()
+	return c.closeRWC()
+}
+
+// closeRWC 关闭底层连接
+func (c *Conn) closeRWC() error {
+	c.doneOnce.Do(func() { close(c.done) })
+	return c.rwc.Close()
+}
+
+// abort 不经过关闭握手直接关闭底层连接, 之后的读取将返回err
+func (c *Conn) abort(err error) {
+	c.abortErr.Store(err)
+	c.closeRWC()
+}
+
+// 等待对端的关闭帧
+func (c *Conn) waitClose() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.rio.Lock()
+		defer c.rio.Unlock()
+		if c.readErr != nil {
+			return
+		}
+		for !c.isCloseReceived() {
+			// 丢弃未读完的帧
+			if c.frameReader != nil {
+				io.Copy(ioutil.Discard, c.frameReader)
+				c.frameReader = nil
+			}
+			if err := c.nextFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(closeHandshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.closeRcvd:
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+func (c *Conn) markCloseReceived() {
+	c.closeRcvdOnce.Do(func() { close(c.closeRcvd) })
+}
+
+func (c *Conn) isCloseReceived() bool {
+	select {
+	case <-c.closeRcvd:
+		return true
+	default:
+		return false
+	}
+}
+
+// Conn 实现了net.Conn: Read跨越消息边界读取, 每次Write发送一条消息
+var _ net.Conn = (*Conn)(nil)
+
 // frameReaderFactory 接口定义了创建帧读取器方法
 type frameReaderFactory interface {
 	NewFrameReader() (r frameReader, err error)
@@ -156,17 +504,27 @@ type frameReader interface {
 	// HeaderReader returns a reader to read header of the frame.
 	HeaderReader() io.Reader
 
+	// fin 返回是否是消息的最后一个分片
+	// 新增的方法不导出, 以免被提升为Conn的公开方法
+	fin() bool
+
+	// rsv 返回帧的RSV1, RSV2和RSV3位
+	rsv() [3]bool
+
 	// TrailerReader returns a reader to read trailer of the frame.
 	// If it returns nil, there is no trailer in the frame.
 	TrailerReader() io.Reader
 
 	// Len returns total length of the frame, including header and trailer.
-	Len() int
+	Len() int64
 }
 
 // frameWriterFactory 接口定义创建帧写入器方法
 type frameWriterFactory interface {
 	NewFrameWriter(payloadType byte) (w frameWriter, err error)
+	// newFragmentWriter 创建消息分片写入器, fin表示是否是最后一个分片
+	// 不导出, 调用者必须持有Conn.wio
+	newFragmentWriter(payloadType byte, fin bool, rsv [3]bool) (w frameWriter, err error)
 }
 
 // 帧载荷写入器
@@ -177,5 +535,5 @@ type frameWriter interface {
 // frameHandler 为处理数据帧定义了接口
 type frameHandler interface {
 	HandleFrame(frame frameReader) (r frameReader, err error)
-	WriteClose(status int) (err error)
+	WriteClose(status int, reason string) (err error)
 }
@@ -0,0 +1,111 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// benchConn 是内存中的连接, 读取时循环返回同一段数据
+type benchConn struct {
+	data []byte
+	off  int
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	if c.off == len(c.data) {
+		c.off = 0
+	}
+	n := copy(p, c.data[c.off:])
+	c.off += n
+	return n, nil
+}
+
+func (c *benchConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *benchConn) Close() error { return nil }
+
+// newBenchConn 创建内存中的连接, 客户端连接发送的帧需要掩码
+func newBenchConn(client bool, rwc io.ReadWriteCloser) *Conn {
+	var req *http.Request
+	if !client {
+		req = &http.Request{}
+	}
+	return newHybiConn(&Config{}, nil, rwc, req)
+}
+
+// encodeMessage 返回客户端(client为true)或服务端连接编码的一条消息
+func encodeMessage(b *testing.B, client bool, msg []byte) []byte {
+	var buf bytes.Buffer
+	rwc := &struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{&buf, &buf, io.NopCloser(nil)}
+	if err := newBenchConn(client, rwc).WriteMessage(BinaryFrame, msg); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var benchSizes = []struct {
+	name string
+	size int
+}{
+	{"16B", 16},
+	{"1KB", 1 << 10},
+	{"64KB", 64 << 10},
+}
+
+func benchmarkWriteMessage(b *testing.B, client bool) {
+	for _, s := range benchSizes {
+		b.Run(s.name, func(b *testing.B) {
+			c := newBenchConn(client, &benchConn{})
+			msg := make([]byte, s.size)
+			b.ReportAllocs()
+			b.SetBytes(int64(s.size))
+			for i := 0; i < b.N; i++ {
+				if err := c.WriteMessage(BinaryFrame, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkReadMessage(b *testing.B, masked bool) {
+	for _, s := range benchSizes {
+		b.Run(s.name, func(b *testing.B) {
+			// 服务端读取客户端发送的掩码帧
+			frame := encodeMessage(b, masked, make([]byte, s.size))
+			c := newBenchConn(!masked, &benchConn{data: frame})
+			b.ReportAllocs()
+			b.SetBytes(int64(s.size))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := c.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteMessageMasked(b *testing.B)   { benchmarkWriteMessage(b, true) }
+func BenchmarkWriteMessageUnmasked(b *testing.B) { benchmarkWriteMessage(b, false) }
+func BenchmarkReadMessageMasked(b *testing.B)    { benchmarkReadMessage(b, true) }
+func BenchmarkReadMessageUnmasked(b *testing.B)  { benchmarkReadMessage(b, false) }
+
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, s := range benchSizes {
+		b.Run(s.name, func(b *testing.B) {
+			data := make([]byte, s.size)
+			b.ReportAllocs()
+			b.SetBytes(int64(s.size))
+			for i := 0; i < b.N; i++ {
+				maskBytes(key, i, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCloseHandshake(t *testing.T) {
+	received := make(chan error, 1)
+	_, url := newTestServer(t, &Server{Handler: func(c *Conn) {
+		_, _, err := c.ReadMessage()
+		received <- err
+	}})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 非法的状态码不发送关闭帧
+	if err := c.CloseWithReason(1006, ""); err != ErrBadCloseStatus {
+		t.Fatalf("close with 1006: %v, want %v", err, ErrBadCloseStatus)
+	}
+	if err := c.CloseWithReason(CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	// 服务端读到对端的状态码和原因
+	want := &CloseError{Code: CloseGoingAway, Text: "bye"}
+	if err := <-received; !reflect.DeepEqual(err, want) {
+		t.Errorf("server read: %v, want %v", err, want)
+	}
+	// 客户端发送关闭帧后不能再发送
+	if err := c.WriteMessage(TextFrame, []byte("x")); err != ErrCloseSent {
+		t.Fatalf("write after close: %v, want %v", err, ErrCloseSent)
+	}
+}
+
+func TestConnInternalMethods(t *testing.T) {
+	// 帧读写接口的内部方法不能被提升为Conn的公开方法
+	typ := reflect.TypeOf(&Conn{})
+	for _, name := range []string{"Fin", "Rsv", "NewFragmentWriter"} {
+		if _, ok := typ.MethodByName(name); ok {
+			t.Errorf("*Conn has method %s", name)
+		}
+	}
+}
+
+func TestNetConnBinary(t *testing.T) {
+	_, url := newEchoServer(t, Config{})
+	c, err := Dial(url, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 作为net.Conn使用时可以传输非utf-8的数据
+	var conn net.Conn = c
+	data := []byte{0xff, 0x00, 0x80, 'a'}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// Read跨越消息边界
+	got := make([]byte, 2*len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if want := append(data, data...); !bytes.Equal(got, want) {
+		t.Fatalf("read % x, want % x", got, want)
+	}
+}